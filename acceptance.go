@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RejectTooLate  = "tooLate"
+	RejectInFuture = "inFuture"
+)
+
+// timestampRejections counts events dropped by the acceptance window, per reason
+type timestampRejections struct {
+	tooLate  int64
+	inFuture int64
+}
+
+var TimestampRejections timestampRejections
+
+func (rejections *timestampRejections) add(reason string) {
+	switch reason {
+	case RejectTooLate:
+		atomic.AddInt64(&rejections.tooLate, 1)
+	case RejectInFuture:
+		atomic.AddInt64(&rejections.inFuture, 1)
+	}
+}
+
+// Counts returns the number of rejected events by reason
+func (rejections *timestampRejections) Counts() map[string]int64 {
+	return map[string]int64{
+		RejectTooLate:  atomic.LoadInt64(&rejections.tooLate),
+		RejectInFuture: atomic.LoadInt64(&rejections.inFuture),
+	}
+}
+
+// rejectTimestamp returns why the event time is outside the acceptance window around now,
+// or "" if it is accepted. Zero limits leave that side of the window open
+func rejectTimestamp(eventTime int64, now time.Time) string {
+	window := Conf().Acceptance
+	if window.MaxEventLateness > 0 && eventTime < now.Unix()-int64(window.MaxEventLateness) {
+		return RejectTooLate
+	}
+	if window.MaxClockSkew > 0 && eventTime > now.Unix()+int64(window.MaxClockSkew) {
+		return RejectInFuture
+	}
+	return ""
+}
+
+// acceptanceHandler returns the acceptance window and the rejected timestamps counters
+func acceptanceHandler(c *gin.Context) {
+	conf := Conf()
+	c.JSON(http.StatusOK, gin.H{
+		"maxEventLateness": conf.Acceptance.MaxEventLateness,
+		"maxClockSkew":     conf.Acceptance.MaxClockSkew,
+		"rejected":         TimestampRejections.Counts(),
+	})
+}
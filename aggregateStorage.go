@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aggregateStorage buffers the sums of one daily table family until the next flush.
+// Totals storages also add their sums to the monthly table of the family.
+// pending holds the rows taken by flushes not written yet, writing the rows being written
+type aggregateStorage struct {
+	name    string
+	family  tableFamily
+	monthly *tableFamily
+	agg     *aggregator
+	mu      sync.Mutex
+	pending *flushJob
+	writing *flushJob
+}
+
+var (
+	DailyMetricsStore  = newAggregateStorage("DailyMetrics", DailyMetricsFamily, nil)
+	DailyMetricsTotals = newAggregateStorage("DailyMetricTotals", DailyMetricTotalsFamily, &MonthlyMetricsFamily)
+	DailySlicesStore   = newAggregateStorage("DailySlices", DailySlicesFamily, nil)
+	DailySlicesTotals  = newAggregateStorage("DailySliceTotals", DailySliceTotalsFamily, &MonthlySlicesFamily)
+)
+
+// newAggregateStorage makes one accumulator per CPU, workers beyond that share them
+func newAggregateStorage(name string, family tableFamily, monthly *tableFamily) *aggregateStorage {
+	return &aggregateStorage{name: name, family: family, monthly: monthly, agg: newAggregator(runtime.NumCPU())}
+}
+
+func (storage *aggregateStorage) minutes() bool {
+	return len(storage.family.keyColumns) > 0 && storage.family.keyColumns[0] == "minute"
+}
+
+// Inc adds the value of the event to the row of its day (and minute) in the accumulator of the worker
+func (storage *aggregateStorage) Inc(worker int, metricId int, sliceId int, event Event) {
+	key := aggregateKey{day: event.Day, metricId: uint32(metricId)}
+	if storage.family.slices {
+		key.sliceId = uint32(sliceId)
+	}
+	if storage.minutes() {
+		key.minute = int16(event.Minute)
+	}
+	storage.agg.Add(worker, key, event.IntValue, event.FloatValue)
+}
+
+// Len returns the number of buffered rows, including the rows of flushes not written yet
+func (storage *aggregateStorage) Len() int {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	rows := storage.agg.Len()
+	if storage.pending != nil {
+		rows += storage.pending.rows
+	}
+	if storage.writing != nil {
+		rows += storage.writing.rows
+	}
+	return rows
+}
+
+func (storage *aggregateStorage) fields() []string {
+	fields := append(storage.family.idColumns(), "value", "value_float")
+	if storage.minutes() {
+		fields = append(fields, "minute")
+	}
+	return fields
+}
+
+func (storage *aggregateStorage) row(key aggregateKey, value aggregateValue) []interface{} {
+	key = MergedIds.remap(key)
+	row := []interface{}{key.metricId}
+	if storage.family.slices {
+		row = append(row, key.sliceId)
+	}
+	row = append(row, value.value, value.valueFloat)
+	if storage.minutes() {
+		row = append(row, key.minute)
+	}
+	return row
+}
+
+// write inserts the rows of a flush job into the daily (and monthly) tables. With Conf.Flush.Transactional
+// the whole job is one transaction, and a job rolled back is given back to the accumulators for the next flush
+func (storage *aggregateStorage) write(ctx context.Context, job *flushJob) error {
+	startTime := time.Now()
+	slog.Debug("Start flushing", "storage", storage.name, "rows", job.rows)
+	var tx *sql.Tx
+	var flushErr error
+	if Conf().Flush.Transactional {
+		//DDL would commit the transaction
+		for day := range job.days {
+			if flushErr = Schema.Ensure(storage.family, dayDateKey(day)); flushErr != nil {
+				break
+			}
+		}
+		if flushErr == nil {
+			tx, flushErr = Db.BeginTx(ctx, nil)
+		}
+		if flushErr == nil {
+			if flushErr = storage.insert(ctx, tx, job); flushErr != nil {
+				tx.Rollback()
+			}
+		}
+		if flushErr != nil {
+			storage.agg.Restore(job.days)
+			slog.Warn("Flush rolled back, rows wait for the next flush", "storage", storage.name, "rows", job.rows, "error", flushErr)
+		} else {
+			//a failed commit may have been applied, its rows are not retried
+			flushErr = tx.Commit()
+		}
+	} else {
+		flushErr = storage.insert(ctx, nil, job)
+	}
+
+	if flushErr != nil {
+		slog.Error("Flush failed", "storage", storage.name, "rows", job.rows, "elapsed", time.Since(startTime), "error", flushErr)
+	} else {
+		slog.Info("Flushed", "storage", storage.name, "rows", job.rows, "elapsed", time.Since(startTime))
+	}
+	observeFlush(storage.name, startTime, job.rows)
+	FlushHealth.Record(storage.name, flushErr)
+	if isRollupSource(storage.family) {
+		//rows of a failed flush may have been written in part
+		for day := range job.days {
+			RollupDays.Add(day)
+		}
+	}
+	return flushErr
+}
+
+func (storage *aggregateStorage) insert(ctx context.Context, tx *sql.Tx, job *flushJob) error {
+	conf := Conf()
+	var flushErr error
+	for day, values := range job.days {
+		dateKey := dayDateKey(day)
+		slog.Debug("Flushing date", "storage", storage.name, "date", dateKey, "rows", len(values))
+		tableName := storage.family.tableName(dateKey)
+		if err := Schema.Ensure(storage.family, dateKey); err != nil {
+			slog.Error("Cannot create table", "storage", storage.name, "table", tableName, "error", err)
+			flushErr = err
+			continue
+		}
+
+		insertData := InsertData{
+			TableName:       tableName,
+			Fields:          storage.fields(),
+			IncrementFields: []string{"value", "value_float"},
+			BatchRows:       conf.Flush.BatchRows[storage.family.name]}
+		for key, value := range values {
+			insertData.AppendValues(storage.row(key, value)...)
+		}
+		if err := storage.insertDaily(ctx, tx, dateKey, insertData); err != nil {
+			if tx != nil {
+				return err
+			}
+			flushErr = err
+		}
+
+		if storage.monthly == nil {
+			continue
+		}
+		date := strings.Replace(dateKey, "_", "-", -1)
+		monthlyData := InsertData{
+			TableName:       storage.monthly.table,
+			Fields:          append(storage.family.idColumns(), "value", "value_float", "date"),
+			IncrementFields: []string{"value", "value_float"},
+			BatchRows:       conf.Flush.BatchRows[storage.monthly.name]}
+		for key, value := range values {
+			monthlyData.AppendValues(append(storage.row(key, value), date)...)
+		}
+		if err := monthlyData.InsertIncrementBatch(ctx, tx); err != nil {
+			if tx != nil {
+				return err
+			}
+			flushErr = err
+		}
+	}
+	return flushErr
+}
+
+// insertDaily inserts into the daily table, recreating it once when it was dropped since it was cached.
+// In a transaction the table is only forgotten, DDL would commit it: the rows are restored and the next
+// flush recreates the table
+func (storage *aggregateStorage) insertDaily(ctx context.Context, tx *sql.Tx, dateKey string, insertData InsertData) error {
+	err := insertData.InsertIncrementBatch(ctx, tx)
+	if !isMissingTable(err) {
+		return err
+	}
+	Schema.Forget(insertData.TableName)
+	if tx != nil {
+		return err
+	}
+	slog.Warn("Recreating dropped table", "storage", storage.name, "table", insertData.TableName)
+	if err := Schema.Ensure(storage.family, dateKey); err != nil {
+		return err
+	}
+	return insertData.InsertIncrementBatch(ctx, nil)
+}
+
+// Snapshot counts the rows of every date not written yet, buffered or taken by a flush, and copies up to limit of them
+func (storage *aggregateStorage) Snapshot(limit int) map[string]bufferedDate {
+	var parts []map[aggregateKey]aggregateValue
+	for _, values := range storage.agg.Peek() {
+		parts = append(parts, values)
+	}
+	//rows taken by a flush stay in memory until written
+	flushing := make(map[int32]int)
+	storage.mu.Lock()
+	for _, job := range []*flushJob{storage.pending, storage.writing} {
+		if job == nil {
+			continue
+		}
+		for day, values := range job.days {
+			copied := make(map[aggregateKey]aggregateValue, len(values))
+			for key, value := range values {
+				copied[key] = value
+			}
+			parts = append(parts, copied)
+			flushing[day] += len(values)
+		}
+	}
+	storage.mu.Unlock()
+	snapshot := make(map[string]bufferedDate)
+	for day, values := range mergeByDay(parts) {
+		var rows []bufferedRow
+		for key, value := range values {
+			if len(rows) >= limit {
+				break
+			}
+			row := bufferedRow{MetricId: int(key.metricId), SliceId: int(key.sliceId), Value: value.value, ValueFloat: value.valueFloat}
+			if storage.minutes() {
+				row.Minute = minutePointer(int(key.minute))
+			}
+			rows = append(rows, row)
+		}
+		snapshot[dayDateKey(day)] = bufferedDate{Rows: len(values), Flushing: flushing[day], Values: rows}
+	}
+	return snapshot
+}
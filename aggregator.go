@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// aggregateKey identifies a buffered row. day is yyyymmdd in local time, see Event.FillMinute, sliceId and minute are 0
+// in storages without them. Ids fit int(10) unsigned columns
+type aggregateKey struct {
+	day      int32
+	minute   int16
+	metricId uint32
+	sliceId  uint32
+}
+
+type aggregateValue struct {
+	value      int64
+	valueFloat float64
+}
+
+// dateDay returns the yyyymmdd day of a local date
+func dateDay(date time.Time) int32 {
+	return int32(date.Year()*10000 + int(date.Month())*100 + date.Day())
+}
+
+// dayDate returns the local midnight of a yyyymmdd day
+func dayDate(day int32) time.Time {
+	return time.Date(int(day/10000), time.Month(day/100%100), int(day%100), 0, 0, 0, 0, time.Local)
+}
+
+// dayDateKey formats a yyyymmdd day as the date suffix of the daily tables, 2006_01_02
+func dayDateKey(day int32) string {
+	return fmt.Sprintf("%04d_%02d_%02d", day/10000, day/100%100, day%100)
+}
+
+// accumulator is the part of an aggregator owned by one ingestion worker. Only the flush competes
+// for its lock, so workers never wait for each other
+type accumulator struct {
+	mu     sync.Mutex
+	values map[aggregateKey]aggregateValue
+	//pads the 16 bytes of fields to a 64-byte cache line, so accumulators do not share one
+	_ [48]byte
+}
+
+// aggregator sums values by key in one accumulator per worker. Flushes take all accumulators
+// at once and merge them, so a key added by several workers is written once
+type aggregator struct {
+	accumulators []accumulator
+	rows         int64
+}
+
+func newAggregator(accumulators int) *aggregator {
+	if accumulators < 1 {
+		accumulators = 1
+	}
+	agg := &aggregator{accumulators: make([]accumulator, accumulators)}
+	for i := range agg.accumulators {
+		agg.accumulators[i].values = make(map[aggregateKey]aggregateValue)
+	}
+	return agg
+}
+
+// Add sums the values into the accumulator of the worker
+func (agg *aggregator) Add(worker int, key aggregateKey, value int64, valueFloat float64) {
+	acc := &agg.accumulators[worker%len(agg.accumulators)]
+	acc.mu.Lock()
+	sum, ok := acc.values[key]
+	sum.value += value
+	sum.valueFloat += valueFloat
+	acc.values[key] = sum
+	acc.mu.Unlock()
+	if !ok {
+		atomic.AddInt64(&agg.rows, 1)
+	}
+}
+
+// Restore adds rows taken by a failed flush back, to the first accumulator
+func (agg *aggregator) Restore(days map[int32]map[aggregateKey]aggregateValue) {
+	for _, values := range days {
+		for key, value := range values {
+			agg.Add(0, key, value.value, value.valueFloat)
+		}
+	}
+}
+
+// Len returns the number of buffered rows, a key buffered by several workers counts once per worker
+func (agg *aggregator) Len() int {
+	return int(atomic.LoadInt64(&agg.rows))
+}
+
+// Take empties the accumulators and returns their rows merged and grouped by day
+func (agg *aggregator) Take() map[int32]map[aggregateKey]aggregateValue {
+	taken := make([]map[aggregateKey]aggregateValue, len(agg.accumulators))
+	for i := range agg.accumulators {
+		acc := &agg.accumulators[i]
+		acc.mu.Lock()
+		taken[i] = acc.values
+		acc.values = make(map[aggregateKey]aggregateValue, len(taken[i]))
+		acc.mu.Unlock()
+		atomic.AddInt64(&agg.rows, -int64(len(taken[i])))
+	}
+	return mergeByDay(taken)
+}
+
+// Peek returns the buffered rows merged and grouped by day, leaving them in place
+func (agg *aggregator) Peek() map[int32]map[aggregateKey]aggregateValue {
+	copies := make([]map[aggregateKey]aggregateValue, len(agg.accumulators))
+	for i := range agg.accumulators {
+		acc := &agg.accumulators[i]
+		acc.mu.Lock()
+		copies[i] = make(map[aggregateKey]aggregateValue, len(acc.values))
+		for key, value := range acc.values {
+			copies[i][key] = value
+		}
+		acc.mu.Unlock()
+	}
+	return mergeByDay(copies)
+}
+
+func mergeByDay(parts []map[aggregateKey]aggregateValue) map[int32]map[aggregateKey]aggregateValue {
+	days := make(map[int32]map[aggregateKey]aggregateValue)
+	for _, part := range parts {
+		for key, value := range part {
+			rows, ok := days[key.day]
+			if !ok {
+				rows = make(map[aggregateKey]aggregateValue)
+				days[key.day] = rows
+			}
+			sum := rows[key]
+			sum.value += value.value
+			sum.valueFloat += value.valueFloat
+			rows[key] = sum
+		}
+	}
+	return days
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestAccumulatorFillsCacheLine(t *testing.T) {
+	if size := unsafe.Sizeof(accumulator{}); size != 64 {
+		t.Fatalf("accumulator is %d bytes, want 64", size)
+	}
+}
+
+type benchEvent struct {
+	event    Event
+	metricId int
+	sliceIds [2]int
+}
+
+func benchEvents(count int, metrics int, slices int) []benchEvent {
+	random := rand.New(rand.NewSource(42))
+	now := time.Now().Unix()
+	tracks := make([]benchEvent, count)
+	for i := range tracks {
+		event := Event{Time: now - int64(random.Intn(86400)), IntValue: 1}
+		event.FillMinute()
+		tracks[i] = benchEvent{
+			event:    event,
+			metricId: 1 + random.Intn(metrics),
+			sliceIds: [2]int{1 + random.Intn(slices), 1 + random.Intn(slices)},
+		}
+	}
+	return tracks
+}
+
+// benchmarkAggregate aggregates events into the four daily storages from GOMAXPROCS goroutines,
+// each with its own accumulator, or all on the same one like a single mutex per storage
+func benchmarkAggregate(b *testing.B, shared bool) {
+	tracks := benchEvents(100000, 1000, 100)
+	storages := []*aggregateStorage{
+		newAggregateStorage("DailyMetrics", DailyMetricsFamily, nil),
+		newAggregateStorage("DailyMetricTotals", DailyMetricTotalsFamily, nil),
+		newAggregateStorage("DailySlices", DailySlicesFamily, nil),
+		newAggregateStorage("DailySliceTotals", DailySliceTotalsFamily, nil),
+	}
+	var workers int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := int(atomic.AddInt64(&workers, 1) - 1)
+		if shared {
+			worker = 0
+		}
+		i := worker * 7919
+		for pb.Next() {
+			track := tracks[i%len(tracks)]
+			storages[0].Inc(worker, track.metricId, 0, track.event)
+			storages[1].Inc(worker, track.metricId, 0, track.event)
+			for _, sliceId := range track.sliceIds {
+				storages[2].Inc(worker, track.metricId, sliceId, track.event)
+				storages[3].Inc(worker, track.metricId, sliceId, track.event)
+			}
+			i++
+		}
+	})
+	b.ReportMetric(float64(runtime.GOMAXPROCS(0)), "workers")
+}
+
+func BenchmarkAggregateOwnAccumulators(b *testing.B) {
+	benchmarkAggregate(b, false)
+}
+
+func BenchmarkAggregateSharedAccumulator(b *testing.B) {
+	benchmarkAggregate(b, true)
+}
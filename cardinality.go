@@ -0,0 +1,192 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// otherSliceName is the slice name that collects values of slices over the cardinality limits
+const otherSliceName = "__other__"
+
+// keep per metric slice sets of the last days only, older dates do not receive events anymore
+const cardinalityKeepDays = 3
+
+// cardinalityGuard enforces Conf.Cardinality before slice ids are resolved, so slices over a limit never
+// reach the slices table. Slices over a limit are folded into otherSliceName of the same category, slices
+// of categories over MaxCategories are dropped. Folded and dropped events are counted per category, under
+// otherSliceName for dropped categories, and per metric
+type cardinalityGuard struct {
+	mu               sync.Mutex
+	categoryNames    map[string]map[string]struct{}
+	metricSlices     map[string]map[string]map[string]struct{}
+	foldedByCategory map[string]int64
+	foldedByMetric   map[string]int64
+}
+
+var Cardinality cardinalityGuard
+
+// Warmup sets the known slice names per category, as loaded from the slices table
+func (guard *cardinalityGuard) Warmup(categoryNames map[string]map[string]struct{}) {
+	guard.mu.Lock()
+	guard.categoryNames = categoryNames
+	guard.mu.Unlock()
+}
+
+// Rename moves a known slice name, keeping the category counts right after renaming slices
+func (guard *cardinalityGuard) Rename(category string, name string, newCategory string, newName string) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	if names, ok := guard.categoryNames[category]; ok {
+		delete(names, name)
+	}
+	if guard.categoryNames == nil {
+		guard.categoryNames = make(map[string]map[string]struct{})
+	}
+	if _, ok := guard.categoryNames[newCategory]; !ok {
+		guard.categoryNames[newCategory] = make(map[string]struct{})
+	}
+	guard.categoryNames[newCategory][newName] = struct{}{}
+}
+
+// Forget removes a slice name merged into another one from the category counts
+func (guard *cardinalityGuard) Forget(category string, name string) {
+	guard.mu.Lock()
+	delete(guard.categoryNames[category], name)
+	guard.mu.Unlock()
+}
+
+// AllowCategory reports whether slices of the category are kept: known and configured categories, and
+// the combinations declared for the metric in Conf.SliceCombinations, always are, new ones while there
+// are less than MaxCategories distinct categories
+func (guard *cardinalityGuard) AllowCategory(conf *Config, metric string, category string) bool {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	if _, ok := guard.categoryNames[category]; ok {
+		return true
+	}
+	limit := conf.Cardinality.MaxCategories
+	if limit > 0 && !conf.exemptCategory(metric, category) && len(guard.categoryNames) >= limit {
+		guard.countFolded(metric, otherSliceName)
+		return false
+	}
+	if guard.categoryNames == nil {
+		guard.categoryNames = make(map[string]map[string]struct{})
+	}
+	guard.categoryNames[category] = make(map[string]struct{})
+	return true
+}
+
+// SliceName returns the name the slice is aggregated under: its own name while the category is under
+// its limit of distinct names and the metric under MaxSlicesPerMetricPerDay on the date, otherSliceName
+// after that. Known names always keep their own name. A new name is recorded only once both limits let it through
+func (guard *cardinalityGuard) SliceName(conf *Config, metric string, dateKey string, category string, name string) string {
+	categoryLimit := conf.Cardinality.categoryLimit(category)
+	metricLimit := conf.Cardinality.MaxSlicesPerMetricPerDay
+	if name == otherSliceName || (categoryLimit <= 0 && metricLimit <= 0) {
+		return name
+	}
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	var names map[string]struct{}
+	if categoryLimit > 0 {
+		names = guard.categoryNames[category]
+		if _, ok := names[name]; !ok && len(names) >= categoryLimit {
+			guard.countFolded(metric, category)
+			return otherSliceName
+		}
+	}
+	var slices map[string]struct{}
+	key := sliceKey(category, name)
+	if metricLimit > 0 {
+		slices = guard.metricSlices[dateKey][metric]
+		if _, ok := slices[key]; !ok && len(slices) >= metricLimit {
+			guard.countFolded(metric, category)
+			return otherSliceName
+		}
+	}
+	if categoryLimit > 0 {
+		if names == nil {
+			if guard.categoryNames == nil {
+				guard.categoryNames = make(map[string]map[string]struct{})
+			}
+			names = make(map[string]struct{})
+			guard.categoryNames[category] = names
+		}
+		names[name] = struct{}{}
+	}
+	if metricLimit > 0 {
+		if slices == nil {
+			slices = guard.metricDaySlices(metric, dateKey)
+		}
+		slices[key] = struct{}{}
+	}
+	return name
+}
+
+// metricDaySlices returns the slice set of the metric on the date, creating it, guard.mu held
+func (guard *cardinalityGuard) metricDaySlices(metric string, dateKey string) map[string]struct{} {
+	if guard.metricSlices == nil {
+		guard.metricSlices = make(map[string]map[string]map[string]struct{})
+	}
+	metrics, ok := guard.metricSlices[dateKey]
+	if !ok {
+		metrics = make(map[string]map[string]struct{})
+		guard.metricSlices[dateKey] = metrics
+		guard.forgetOldDates()
+	}
+	slices, ok := metrics[metric]
+	if !ok {
+		slices = make(map[string]struct{})
+		metrics[metric] = slices
+	}
+	return slices
+}
+
+func (guard *cardinalityGuard) forgetOldDates() {
+	if len(guard.metricSlices) <= cardinalityKeepDays {
+		return
+	}
+	dateKeys := make([]string, 0, len(guard.metricSlices))
+	for dateKey := range guard.metricSlices {
+		dateKeys = append(dateKeys, dateKey)
+	}
+	sort.Strings(dateKeys)
+	for _, dateKey := range dateKeys[:len(dateKeys)-cardinalityKeepDays] {
+		delete(guard.metricSlices, dateKey)
+	}
+}
+
+func (guard *cardinalityGuard) countFolded(metric string, category string) {
+	if guard.foldedByCategory == nil {
+		guard.foldedByCategory = make(map[string]int64)
+		guard.foldedByMetric = make(map[string]int64)
+	}
+	guard.foldedByCategory[category]++
+	guard.foldedByMetric[metric]++
+}
+
+// Folded returns copies of the folded event counters per category and per metric
+func (guard *cardinalityGuard) Folded() (map[string]int64, map[string]int64) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	byCategory := make(map[string]int64, len(guard.foldedByCategory))
+	for category, count := range guard.foldedByCategory {
+		byCategory[category] = count
+	}
+	byMetric := make(map[string]int64, len(guard.foldedByMetric))
+	for metric, count := range guard.foldedByMetric {
+		byMetric[metric] = count
+	}
+	return byCategory, byMetric
+}
+
+func cardinalityHandler(c *gin.Context) {
+	byCategory, byMetric := Cardinality.Folded()
+	c.JSON(http.StatusOK, gin.H{
+		"otherSliceName":   otherSliceName,
+		"foldedByCategory": byCategory,
+		"foldedByMetric":   byMetric,
+	})
+}
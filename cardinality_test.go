@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+type sliceCase struct {
+	metric   string
+	dateKey  string
+	category string
+	name     string
+	want     string
+}
+
+func TestSliceNameFoldsToOther(t *testing.T) {
+	config := &Config{}
+	config.Cardinality = CardinalityConfig{
+		MaxSlicesPerCategory:     2,
+		CategoryLimits:           map[string]int{"country": 3},
+		MaxSlicesPerMetricPerDay: 3,
+	}
+	tests := []struct {
+		name   string
+		slices []sliceCase
+	}{
+		{"category limit", []sliceCase{
+			{"login", "2017_07_14", "platform", "ios", "ios"},
+			{"login", "2017_07_14", "platform", "android", "android"},
+			{"login", "2017_07_14", "platform", "web", otherSliceName},
+			{"login", "2017_07_14", "platform", "ios", "ios"},
+		}},
+		{"configured category limit", []sliceCase{
+			{"login", "2017_07_14", "country", "US", "US"},
+			{"login", "2017_07_14", "country", "FR", "FR"},
+			{"login", "2017_07_14", "country", "DE", "DE"},
+			{"login", "2017_07_14", "country", "IT", otherSliceName},
+		}},
+		{"metric limit per day", []sliceCase{
+			{"login", "2017_07_14", "platform", "ios", "ios"},
+			{"login", "2017_07_14", "country", "US", "US"},
+			{"login", "2017_07_14", "country", "FR", "FR"},
+			{"login", "2017_07_14", "country", "DE", otherSliceName},
+			{"purchase", "2017_07_14", "country", "DE", "DE"},
+			{"login", "2017_07_15", "country", "DE", "DE"},
+		}},
+		{"names folded by the metric limit do not use up the category limit", []sliceCase{
+			{"login", "2017_07_14", "platform", "ios", "ios"},
+			{"login", "2017_07_14", "country", "US", "US"},
+			{"login", "2017_07_14", "country", "FR", "FR"},
+			{"login", "2017_07_14", "country", "DE", otherSliceName},
+			{"login", "2017_07_14", "country", "IT", otherSliceName},
+			{"purchase", "2017_07_14", "country", "ES", "ES"},
+		}},
+		{"other is kept", []sliceCase{
+			{"login", "2017_07_14", "platform", otherSliceName, otherSliceName},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var guard cardinalityGuard
+			for _, slice := range test.slices {
+				got := guard.SliceName(config, slice.metric, slice.dateKey, slice.category, slice.name)
+				if got != slice.want {
+					t.Errorf("SliceName(%s, %s, %s=%s) = %q, want %q",
+						slice.metric, slice.dateKey, slice.category, slice.name, got, slice.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowCategory(t *testing.T) {
+	config := &Config{SliceCombinations: map[string][][]string{"purchase": {{"country", "platform"}}}}
+	config.Cardinality = CardinalityConfig{MaxCategories: 2, CategoryLimits: map[string]int{"city": 10}}
+	tests := []struct {
+		metric   string
+		category string
+		want     bool
+	}{
+		{"login", "country", true},
+		{"login", "platform", true},
+		{"login", "version", false},
+		{"login", "country", true},
+		{"login", "city", true},
+		{"purchase", "country|platform", true},
+		{"login", "country|version", false},
+	}
+	var guard cardinalityGuard
+	for _, test := range tests {
+		if got := guard.AllowCategory(config, test.metric, test.category); got != test.want {
+			t.Errorf("AllowCategory(%s, %s) = %v, want %v", test.metric, test.category, got, test.want)
+		}
+	}
+	byCategory, byMetric := guard.Folded()
+	if byCategory[otherSliceName] != 2 || byMetric["login"] != 2 {
+		t.Errorf("Folded() = %v, %v, want 2 dropped login events", byCategory, byMetric)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 	"os"
+	"reflect"
 )
 
 type Config struct {
@@ -12,6 +14,22 @@ type Config struct {
 	Gin                        GinConfig
 	FlushToDbInterval          int
 	FlushTotalsInterval        int
+	FloatValueMetrics          []string
+	IdSpaceWarningPercent      int
+	Cardinality                CardinalityConfig
+	SliceCombinations          map[string][][]string
+	Registry                   RegistryConfig
+	Retention                  RetentionConfig
+	Rollup                     RollupConfig
+	Schema                     SchemaConfig
+	Acceptance                 AcceptanceConfig
+	Timestamping               TimestampingConfig
+	Dedup                      DedupConfig
+	Health                     HealthConfig
+	Ingestion                  IngestionConfig
+	Flush                      FlushConfig
+	Cors                       CorsConfig
+	Log                        LogConfig
 }
 
 type DbConfig struct {
@@ -24,6 +42,127 @@ type DbConfig struct {
 	Timeout  int
 }
 
+// CardinalityConfig limits distinct slices, 0 means no limit. MaxCategories bounds the distinct
+// categories, those of CategoryLimits excepted, so new categories cannot add MaxSlicesPerCategory each
+type CardinalityConfig struct {
+	MaxSlicesPerCategory     int
+	CategoryLimits           map[string]int
+	MaxSlicesPerMetricPerDay int
+	MaxCategories            int
+}
+
+type RegistryConfig struct {
+	//accept only events of metrics registered through the registry API
+	Strict bool
+	//create metrics on their first event, defaults to true
+	AutoCreate bool
+	//seconds between reloads of the registry, picking up changes made through other instances
+	RefreshInterval int
+}
+
+// RetentionConfig keeps the daily tables of a family (DailyMetrics, DailyMetricTotals, DailySlices,
+// DailySliceTotals) for Days[family] days, 0 or a missing family keeps them forever
+type RetentionConfig struct {
+	Days          map[string]int
+	CheckInterval int
+}
+
+type RollupConfig struct {
+	//seconds between rebuilds of the rollups of today and yesterday
+	Interval int
+}
+
+// AcceptanceConfig bounds the event times accepted by /track, in seconds around the receive time,
+// 0 means no limit. /backfill bypasses the window and is enabled by BackfillUser
+type AcceptanceConfig struct {
+	MaxEventLateness int
+	MaxClockSkew     int
+	BackfillUser     string
+	BackfillPassword string
+}
+
+// TimestampingConfig is the default TimestampPolicy of /track and /backfill, Accounts override it
+// for some credentials and requests override both with the X-Timestamp-Mode header
+type TimestampingConfig struct {
+	Mode      string
+	Tolerance int
+	Accounts  map[string]TimestampPolicy
+}
+
+// DedupConfig keeps Idempotency-Key headers and event ids for Ttl seconds, in the dedup_keys table too with Persist
+type DedupConfig struct {
+	Ttl     int
+	Persist bool
+	//keys kept in memory, the ones closest to expiry are evicted past it
+	MaxKeys int
+}
+
+// HealthConfig are the limits of /readyz, 0 means the default
+type HealthConfig struct {
+	//seconds since the last successful flush of a storage, defaults to three flush intervals
+	MaxFlushAge int
+	//rows buffered by all storages, 0 disables the check
+	MaxBufferedRows int
+	//seconds, defaults to 2
+	DbPingTimeout int
+}
+
+// IngestionConfig bounds the queue between /track and the aggregation workers, 0 means the default
+type IngestionConfig struct {
+	//aggregation workers, defaults to the number of CPUs
+	Workers int
+	//batches waiting for a worker, defaults to 1000
+	QueueSize int
+	//events waiting for a worker, defaults to 1000000
+	MaxQueuedEvents int
+	//bytes of a compressed request body, defaults to 10MB
+	MaxBodyBytes int64
+	//bytes of a decompressed request body, defaults to 100MB
+	MaxDecompressedBytes int64
+	//rows buffered by all storages above which /track answers 503, 0 disables the check
+	MaxBufferedRows int
+	//seconds sent in the Retry-After header of 429 and 503 answers, defaults to 5
+	RetryAfter int
+}
+
+// FlushConfig tunes the background writes of the flushed rows, 0 means the default
+type FlushConfig struct {
+	//storages written at the same time, defaults to 2
+	Concurrency int
+	//seconds a flush may write before its statements are cancelled, defaults to 60
+	Timeout int
+	//rows per INSERT statement by table family (DailyMetrics, DailyMetricTotals, DailySlices,
+	//DailySliceTotals, MonthlyMetrics, MonthlySlices), 40000 placeholders by default
+	BatchRows map[string]int
+	//write every flush of a storage in one transaction, rolled back flushes are retried with the next one
+	Transactional bool
+	//prepared INSERT statements kept for reuse, defaults to 64
+	StatementCacheSize int
+}
+
+type CorsConfig struct {
+	//allowed origins, all of them when empty
+	AllowOrigins []string
+	//request headers allowed besides the defaults
+	AllowHeaders []string
+}
+
+type LogConfig struct {
+	//debug, info, warn or error, defaults to info
+	Level string
+	//json or logfmt, defaults to json
+	Format string
+	//noisy messages, like skipped events, are logged SampleBurst times per SampleInterval seconds,
+	//defaults to 10 per 10 seconds
+	SampleInterval int
+	SampleBurst    int
+}
+
+type SchemaConfig struct {
+	//local time (HH:MM) at which tomorrow's daily tables are created
+	PrecreateTablesAt string
+}
+
 type GinConfig struct {
 	Mode            string
 	Host            string
@@ -33,17 +172,56 @@ type GinConfig struct {
 	TlsEnabled      bool
 	TlsCertFilePath string
 	TlsKeyFilePath  string
+	//more accounts allowed to POST /track only, user: password
+	Accounts map[string]string
 }
 
-func (config *Config) Init() error {
+// Init reads the config file at path, applies the REALMETRIC_* environment variables and validates the result
+func (config *Config) Init(path string) error {
 	//read config
-	jsonFile, err := os.Open("config.json5")
-	defer jsonFile.Close()
+	jsonFile, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer jsonFile.Close()
+	config.Registry.AutoCreate = true
 	dec := json5.NewDecoder(jsonFile)
-	err = dec.Decode(config)
+	if err = dec.Decode(config); err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	if err = applyEnv(reflect.ValueOf(config).Elem(), envPrefix); err != nil {
+		return err
+	}
+	return config.Validate()
+}
+
+// IsFloatMetric reports whether values of the metric are accumulated as floats instead of signed integers
+func (config *Config) IsFloatMetric(metricName string) bool {
+	for _, name := range config.FloatValueMetrics {
+		if name == metricName {
+			return true
+		}
+	}
+	return false
+}
 
-	return err
+// exemptCategory reports whether the category is exempt from MaxCategories: it has its own limit in
+// CategoryLimits or is a combination declared for the metric
+func (config *Config) exemptCategory(metric string, category string) bool {
+	if _, ok := config.Cardinality.CategoryLimits[category]; ok {
+		return true
+	}
+	for _, categories := range config.SliceCombinations[metric] {
+		if combinationCategory(categories) == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *CardinalityConfig) categoryLimit(category string) int {
+	if limit, ok := config.CategoryLimits[category]; ok {
+		return limit
+	}
+	return config.MaxSlicesPerCategory
 }
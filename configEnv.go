@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	envPrefix         = "REALMETRIC"
+	defaultConfigPath = "config.json5"
+	redacted          = "******"
+)
+
+// envName turns a field name into its environment variable part, TlsCertFilePath into TLS_CERT_FILE_PATH
+func envName(field string) string {
+	runes := []rune(field)
+	var name []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
+}
+
+// applyEnv overrides the fields of a config struct with the environment variables named after their
+// path, e.g. REALMETRIC_DB_PASSWORD for Db.Password. Lists are comma separated or JSON, maps are JSON
+func applyEnv(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := prefix + "_" + envName(value.Type().Field(i).Name)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(field, env); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func setFromEnv(field reflect.Value, env string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(env)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(number)
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		field.SetBool(flag)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(env), "[") {
+			list := []string{}
+			for _, item := range strings.Split(env, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		return json.Unmarshal([]byte(env), field.Addr().Interface())
+	default:
+		return json.Unmarshal([]byte(env), field.Addr().Interface())
+	}
+	return nil
+}
+
+// Validate checks the settings the service cannot start without and returns all problems at once
+func (config *Config) Validate() error {
+	var problems []string
+	for _, field := range []struct{ name, value string }{
+		{"Db.Host", config.Db.Host},
+		{"Db.User", config.Db.User},
+		{"Db.Database", config.Db.Database},
+		{"Gin.User", config.Gin.User},
+		{"Gin.Password", config.Gin.Password},
+	} {
+		if field.value == "" {
+			problems = append(problems, field.name+" is required")
+		}
+	}
+	if config.Db.Port <= 0 || config.Gin.Port <= 0 {
+		problems = append(problems, "Db.Port and Gin.Port must be positive")
+	}
+	if config.FlushToDbInterval <= 0 || config.FlushTotalsInterval <= 0 {
+		problems = append(problems, "FlushToDbInterval and FlushTotalsInterval must be positive")
+	}
+	for name, expression := range map[string]string{
+		"MetricNameValidationRegexp": config.MetricNameValidationRegexp,
+		"SliceNameValidationRegexp":  config.SliceNameValidationRegexp,
+	} {
+		if _, err := regexp.Compile(expression); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+	}
+	if config.Gin.TlsEnabled && (config.Gin.TlsCertFilePath == "" || config.Gin.TlsKeyFilePath == "") {
+		problems = append(problems, "Gin.TlsCertFilePath and Gin.TlsKeyFilePath are required with Gin.TlsEnabled")
+	}
+	if config.Acceptance.BackfillUser != "" && config.Acceptance.BackfillPassword == "" {
+		problems = append(problems, "Acceptance.BackfillPassword is required with Acceptance.BackfillUser")
+	}
+	if config.Timestamping.Mode != "" && !validTimestampMode(config.Timestamping.Mode) {
+		problems = append(problems, "Timestamping.Mode must be client, server or tolerance")
+	}
+	for account, policy := range config.Timestamping.Accounts {
+		if !validTimestampMode(policy.Mode) {
+			problems = append(problems, "Timestamping.Accounts."+account+".Mode must be client, server or tolerance")
+		}
+	}
+	if _, ok := parseLogLevel(config.Log.Level); !ok {
+		problems = append(problems, "Log.Level must be debug, info, warn or error")
+	}
+	if !validLogFormat(config.Log.Format) {
+		problems = append(problems, "Log.Format must be json or logfmt")
+	}
+	if err := corsConfig(config).Validate(); err != nil {
+		problems = append(problems, "Cors: "+err.Error())
+	}
+	for name, rows := range config.Flush.BatchRows {
+		problems = append(problems, batchRowsProblems(name, rows)...)
+	}
+	if config.Schema.PrecreateTablesAt != "" {
+		if _, err := time.Parse("15:04", config.Schema.PrecreateTablesAt); err != nil {
+			problems = append(problems, "Schema.PrecreateTablesAt must be HH:MM")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// batchRowsProblems checks Flush.BatchRows of a family: a family flushes insert into, with statements
+// under the placeholders a prepared statement may have
+func batchRowsProblems(name string, rows int) []string {
+	var names []string
+	for _, family := range flushedFamilies {
+		if family.name != name {
+			names = append(names, family.name)
+			continue
+		}
+		if rows < 0 || rows*family.insertColumns() > maxPlaceholders {
+			return []string{"Flush.BatchRows." + name + " must be between 0 and " + strconv.Itoa(maxPlaceholders/family.insertColumns()) +
+				", " + strconv.Itoa(family.insertColumns()) + " placeholders per row"}
+		}
+		return nil
+	}
+	return []string{"Flush.BatchRows." + name + " is not a table family, one of " + strings.Join(names, ", ")}
+}
+
+// Redacted returns a copy of the config without its passwords
+func (config *Config) Redacted() Config {
+	copied := *config
+	if copied.Db.Password != "" {
+		copied.Db.Password = redacted
+	}
+	if copied.Gin.Password != "" {
+		copied.Gin.Password = redacted
+	}
+	if copied.Acceptance.BackfillPassword != "" {
+		copied.Acceptance.BackfillPassword = redacted
+	}
+	copied.Gin.Accounts = make(map[string]string, len(config.Gin.Accounts))
+	for user := range config.Gin.Accounts {
+		copied.Gin.Accounts[user] = redacted
+	}
+	return copied
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useConfig makes config the current config for the duration of the test
+func useConfig(t *testing.T, config *Config) {
+	t.Helper()
+	previous := currentConf.Load()
+	currentConf.Store(config)
+	t.Cleanup(func() { currentConf.Store(previous) })
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct{ field, want string }{
+		{"Host", "HOST"},
+		{"TlsCertFilePath", "TLS_CERT_FILE_PATH"},
+		{"FlushToDbInterval", "FLUSH_TO_DB_INTERVAL"},
+		{"MaxSlicesPerMetricPerDay", "MAX_SLICES_PER_METRIC_PER_DAY"},
+		{"BackfillUser", "BACKFILL_USER"},
+		{"HTTPPort", "HTTP_PORT"},
+		{"Db2Host", "DB2_HOST"},
+	}
+	for _, test := range tests {
+		if got := envName(test.field); got != test.want {
+			t.Errorf("envName(%q) = %q, want %q", test.field, got, test.want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(config *Config) bool
+	}{
+		{"string", map[string]string{"REALMETRIC_DB_PASSWORD": "secret"},
+			func(config *Config) bool { return config.Db.Password == "secret" }},
+		{"int", map[string]string{"REALMETRIC_GIN_PORT": "9090"},
+			func(config *Config) bool { return config.Gin.Port == 9090 }},
+		{"bool", map[string]string{"REALMETRIC_GIN_TLS_ENABLED": "true"},
+			func(config *Config) bool { return config.Gin.TlsEnabled }},
+		{"comma separated list", map[string]string{"REALMETRIC_FLOAT_VALUE_METRICS": "price, duration,,"},
+			func(config *Config) bool {
+				return reflect.DeepEqual(config.FloatValueMetrics, []string{"price", "duration"})
+			}},
+		{"json list", map[string]string{"REALMETRIC_FLOAT_VALUE_METRICS": `["a,b"]`},
+			func(config *Config) bool { return reflect.DeepEqual(config.FloatValueMetrics, []string{"a,b"}) }},
+		{"json map", map[string]string{"REALMETRIC_CARDINALITY_CATEGORY_LIMITS": `{"country": 300}`},
+			func(config *Config) bool { return config.Cardinality.CategoryLimits["country"] == 300 }},
+		{"unset keeps the file value", map[string]string{},
+			func(config *Config) bool { return config.Db.Host == "localhost" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config := Config{}
+			config.Db.Host = "localhost"
+			if err := applyEnv(reflect.ValueOf(&config).Elem(), envPrefix); err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(&config) {
+				t.Errorf("applyEnv() with %v did not apply", test.env)
+			}
+		})
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct{ name, value string }{
+		{"REALMETRIC_GIN_PORT", "http"},
+		{"REALMETRIC_GIN_TLS_ENABLED", "maybe"},
+		{"REALMETRIC_CARDINALITY_CATEGORY_LIMITS", "country=300"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.name, test.value)
+			config := Config{}
+			err := applyEnv(reflect.ValueOf(&config).Elem(), envPrefix)
+			if err == nil || !strings.HasPrefix(err.Error(), test.name+": ") {
+				t.Errorf("applyEnv() error = %v, want one naming %s", err, test.name)
+			}
+		})
+	}
+}
+
+func TestBatchRowsProblems(t *testing.T) {
+	family := flushedFamilies[0]
+	maxRows := maxPlaceholders / family.insertColumns()
+	tests := []struct {
+		name     string
+		family   string
+		rows     int
+		problems int
+	}{
+		{"default", family.name, 0, 0},
+		{"largest", family.name, maxRows, 0},
+		{"over the placeholders", family.name, maxRows + 1, 1},
+		{"negative", family.name, -1, 1},
+		{"unknown family", "daily_unknown", 100, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := batchRowsProblems(test.family, test.rows); len(got) != test.problems {
+				t.Errorf("batchRowsProblems(%q, %d) = %v, want %d problems", test.family, test.rows, got, test.problems)
+			}
+		})
+	}
+}
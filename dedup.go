@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	defaultDedupTtl      = 86400
+	defaultDedupMaxKeys  = 1000000
+	//keys expiring within the same bucket are expired, or evicted, together
+	dedupBucketSeconds = 60
+)
+
+// dedupStore remembers, by digest, idempotency keys of batches and event ids for Conf.Dedup.Ttl seconds, so
+// retried uploads are acknowledged without being counted again. With Conf.Dedup.Persist the keys
+// are claimed in the dedup_keys table too, surviving restarts and shared between instances.
+// Keys are grouped in buckets by expiry, so expiring them touches the expired keys only. Past
+// Conf.Dedup.MaxKeys the keys closest to expiry are evicted; with Persist the table still has them
+type dedupStore struct {
+	mu      sync.Mutex
+	keys    map[string]int64
+	buckets map[int64][]string
+}
+
+var Dedup dedupStore
+
+func (store *dedupStore) ttl() int64 {
+	conf := Conf()
+	if conf.Dedup.Ttl <= 0 {
+		return defaultDedupTtl
+	}
+	return int64(conf.Dedup.Ttl)
+}
+
+func (store *dedupStore) maxKeys() int {
+	conf := Conf()
+	if conf.Dedup.MaxKeys <= 0 {
+		return defaultDedupMaxKeys
+	}
+	return conf.Dedup.MaxKeys
+}
+
+// Start creates the dedup_keys table if needed and expires the keys every minute
+func (store *dedupStore) Start() {
+	if Conf().Dedup.Persist {
+		_, err := Db.Exec("CREATE TABLE IF NOT EXISTS `dedup_keys` (" +
+			"`key` varchar(255) COLLATE utf8_bin NOT NULL," +
+			"`expires_at` int(10) unsigned NOT NULL," +
+			"`claim` char(32) COLLATE utf8_bin NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (`key`)," +
+			"KEY `dedup_keys_expires_at_index` (`expires_at`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci")
+		if err != nil {
+			fatal("Cannot create dedup_keys", "table", "dedup_keys", "error", err)
+		}
+		columns, err := tableColumns("dedup_keys")
+		if err == nil {
+			if _, ok := columns["claim"]; !ok {
+				_, err = Db.Exec("ALTER TABLE `dedup_keys` ADD `claim` char(32) COLLATE utf8_bin NOT NULL DEFAULT ''")
+			}
+		}
+		if err != nil {
+			fatal("Cannot add dedup_keys.claim", "table", "dedup_keys", "error", err)
+		}
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			store.expire(now.Unix())
+		}
+	}()
+}
+
+func (store *dedupStore) expire(now int64) {
+	store.mu.Lock()
+	for bucket := range store.buckets {
+		if (bucket+1)*dedupBucketSeconds <= now {
+			store.dropBucket(bucket)
+		}
+	}
+	store.mu.Unlock()
+	if Conf().Dedup.Persist {
+		if _, err := Db.Exec("DELETE FROM dedup_keys WHERE expires_at <= ?", now); err != nil {
+			slog.Error("Cannot expire dedup keys", "table", "dedup_keys", "error", err)
+		}
+	}
+}
+
+// dropBucket forgets the keys of the bucket, store.mu held
+func (store *dedupStore) dropBucket(bucket int64) {
+	for _, key := range store.buckets[bucket] {
+		if store.keys[key]/dedupBucketSeconds == bucket {
+			delete(store.keys, key)
+		}
+	}
+	delete(store.buckets, bucket)
+}
+
+// evict drops the buckets closest to expiry until there is room for one more key, store.mu held
+func (store *dedupStore) evict() {
+	for len(store.keys) >= store.maxKeys() && len(store.buckets) > 0 {
+		oldest := int64(-1)
+		for bucket := range store.buckets {
+			if oldest < 0 || bucket < oldest {
+				oldest = bucket
+			}
+		}
+		evicted := len(store.keys)
+		store.dropBucket(oldest)
+		logSampled(slog.LevelWarn, "Evicted dedup keys", "keys", evicted-len(store.keys), "maxKeys", store.maxKeys())
+	}
+}
+
+// claimInMemory records the keys not claimed within the ttl and returns whether each was
+func (store *dedupStore) claimInMemory(keys []string, now int64) []bool {
+	expiresAt := now + store.ttl()
+	bucket := expiresAt / dedupBucketSeconds
+	claimed := make([]bool, len(keys))
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.keys == nil {
+		store.keys = make(map[string]int64)
+		store.buckets = make(map[int64][]string)
+	}
+	for i, key := range keys {
+		if store.keys[key] > now {
+			continue
+		}
+		store.evict()
+		store.keys[key] = expiresAt
+		store.buckets[bucket] = append(store.buckets[bucket], key)
+		claimed[i] = true
+	}
+	return claimed
+}
+
+// Claim records the key and returns true, or returns false if the key was claimed within the ttl
+func (store *dedupStore) Claim(key string) bool {
+	return store.ClaimAll([]string{key})[0]
+}
+
+// dedupDigest returns the sha256 of the key in hex. Keys embed client ids of any length, their digests
+// fit dedup_keys.key and do not collide when truncated
+func dedupDigest(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// ClaimAll is Claim for the keys of a request, with one round-trip to the dedup_keys table.
+// Keys are accepted when the table cannot be reached
+func (store *dedupStore) ClaimAll(keys []string) []bool {
+	now := time.Now().Unix()
+	digests := make([]string, len(keys))
+	for i, key := range keys {
+		digests[i] = dedupDigest(key)
+	}
+	keys = digests
+	claimed := store.claimInMemory(keys, now)
+	if !Conf().Dedup.Persist {
+		return claimed
+	}
+	var pending []string
+	for i, key := range keys {
+		if claimed[i] {
+			pending = append(pending, key)
+		}
+	}
+	if len(pending) == 0 {
+		return claimed
+	}
+	won, err := claimPersisted(pending, now, now+store.ttl())
+	if err != nil {
+		logSampled(slog.LevelError, "Cannot claim dedup keys", "table", "dedup_keys", "keys", len(pending), "error", err)
+		return claimed
+	}
+	for i, key := range keys {
+		if claimed[i] && !won[key] {
+			claimed[i] = false
+		}
+	}
+	return claimed
+}
+
+// claimPersisted inserts the keys, or takes over their expired rows, tagged with a claim token unique to
+// the call, then reads back which rows carry the token: the keys claimed by this call
+func claimPersisted(keys []string, now int64, expiresAt int64) (map[string]bool, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	claim := hex.EncodeToString(token)
+	won := make(map[string]bool, len(keys))
+	for start := 0; start < len(keys); start += resolveBatchSize {
+		end := start + resolveBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		args := make([]interface{}, 0, (end-start)*3+1)
+		names := make([]interface{}, 0, end-start+1)
+		for _, key := range keys[start:end] {
+			args = append(args, key, expiresAt, claim)
+			names = append(names, key)
+		}
+		args = append(args, now)
+		//claim is assigned first, it compares the expiry of the row before the update
+		_, err := Db.Exec("INSERT INTO dedup_keys (`key`, expires_at, claim) VALUES "+placeholderGroups(end-start, 3)+
+			" ON DUPLICATE KEY UPDATE claim = IF(expires_at <= ?, VALUES(claim), claim), "+
+			"expires_at = IF(claim = VALUES(claim), VALUES(expires_at), expires_at)", args...)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := Db.Query("SELECT `key` FROM dedup_keys WHERE claim = ? AND `key` IN "+placeholderGroups(1, len(names)),
+			append([]interface{}{claim}, names...)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			won[key] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return won, nil
+}
+
+// dropDuplicates drops the events whose Id was already claimed by the account and returns their number
+func dropDuplicates(tracks []Event, account string) ([]Event, int) {
+	var keys []string
+	for _, event := range tracks {
+		if event.Id != "" {
+			keys = append(keys, account+":event:"+event.Id)
+		}
+	}
+	if len(keys) == 0 {
+		return tracks, 0
+	}
+	claimed := Dedup.ClaimAll(keys)
+	accepted := tracks[:0]
+	duplicates := 0
+	i := 0
+	for _, event := range tracks {
+		if event.Id != "" {
+			i++
+			if !claimed[i-1] {
+				duplicates++
+				continue
+			}
+		}
+		accepted = append(accepted, event)
+	}
+	return accepted, duplicates
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClaimInMemory(t *testing.T) {
+	type claim struct {
+		keys []string
+		now  int64
+		want []bool
+	}
+	tests := []struct {
+		name    string
+		maxKeys int
+		claims  []claim
+	}{
+		{"duplicates", 100, []claim{
+			{[]string{"a", "b"}, 1000, []bool{true, true}},
+			{[]string{"a", "c"}, 1010, []bool{false, true}},
+		}},
+		{"duplicates within a request", 100, []claim{
+			{[]string{"a", "a"}, 1000, []bool{true, false}},
+		}},
+		{"expired", 100, []claim{
+			{[]string{"a"}, 1000, []bool{true}},
+			{[]string{"a"}, 1000 + 3599, []bool{false}},
+			{[]string{"a"}, 1000 + 3600, []bool{true}},
+		}},
+		{"evicted closest to expiry", 2, []claim{
+			{[]string{"a"}, 1000, []bool{true}},
+			{[]string{"b"}, 1000 + dedupBucketSeconds, []bool{true}},
+			{[]string{"c"}, 1000 + 2*dedupBucketSeconds, []bool{true}},
+			{[]string{"b", "a"}, 1000 + 2*dedupBucketSeconds, []bool{false, true}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{}
+			config.Dedup = DedupConfig{Ttl: 3600, MaxKeys: test.maxKeys}
+			useConfig(t, config)
+			var store dedupStore
+			for _, claim := range test.claims {
+				if got := store.claimInMemory(claim.keys, claim.now); !reflect.DeepEqual(got, claim.want) {
+					t.Errorf("claimInMemory(%v, %d) = %v, want %v", claim.keys, claim.now, got, claim.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	config := &Config{}
+	config.Dedup = DedupConfig{Ttl: 3600}
+	useConfig(t, config)
+	var store dedupStore
+	store.claimInMemory([]string{"a"}, 1000)
+	store.claimInMemory([]string{"b"}, 2000)
+	store.expire(1000 + 3600 + dedupBucketSeconds)
+	if _, ok := store.keys["a"]; ok {
+		t.Error("expire() kept an expired key")
+	}
+	if _, ok := store.keys["b"]; !ok {
+		t.Error("expire() dropped a live key")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bufferedStorage is an in-memory storage flushed to its daily tables
+type bufferedStorage interface {
+	FlushToDb() int
+	Len() int
+	Lag() time.Duration
+	Snapshot(limit int) map[string]bufferedDate
+}
+
+// bufferedRow is a row waiting for the next flush. SliceId and Minute are missing in storages without them
+type bufferedRow struct {
+	MetricId   int     `json:"metricId"`
+	Metric     string  `json:"metric,omitempty"`
+	SliceId    int     `json:"sliceId,omitempty"`
+	Category   string  `json:"category,omitempty"`
+	Slice      string  `json:"slice,omitempty"`
+	Minute     *int    `json:"minute,omitempty"`
+	Value      int64   `json:"value"`
+	ValueFloat float64 `json:"valueFloat"`
+}
+
+// bufferedDate counts the rows of a date not written yet and lists some of them. Flushing counts
+// the rows taken by a flush pending or being written, the same key may be buffered again
+type bufferedDate struct {
+	Rows     int           `json:"rows"`
+	Flushing int           `json:"flushing"`
+	Values   []bufferedRow `json:"values"`
+}
+
+func minutePointer(minute int) *int {
+	return &minute
+}
+
+func storagesByName() map[string]bufferedStorage {
+	return map[string]bufferedStorage{
+		DailyMetricsStore.name:  DailyMetricsStore,
+		DailyMetricsTotals.name: DailyMetricsTotals,
+		DailySlicesStore.name:   DailySlicesStore,
+		DailySlicesTotals.name:  DailySlicesTotals,
+	}
+}
+
+// flushControl runs the flush tickers and pauses them. Forced flushes run while paused
+type flushControl struct {
+	mu           sync.Mutex
+	paused       bool
+	pausedAt     time.Time
+	dailyTicker  *time.Ticker
+	totalsTicker *time.Ticker
+}
+
+var FlushControl flushControl
+
+// StartTickers schedules flushes of the daily storages every Conf.FlushToDbInterval seconds and of
+// the totals storages every Conf.FlushTotalsInterval seconds
+func (control *flushControl) StartTickers() {
+	conf := Conf()
+	control.mu.Lock()
+	control.dailyTicker = time.NewTicker(time.Duration(conf.FlushToDbInterval) * time.Second)
+	control.totalsTicker = time.NewTicker(time.Duration(conf.FlushTotalsInterval) * time.Second)
+	control.mu.Unlock()
+	go control.run(control.dailyTicker, DailyMetricsStore, DailySlicesStore)
+	go control.run(control.totalsTicker, DailyMetricsTotals, DailySlicesTotals)
+}
+
+func (control *flushControl) run(ticker *time.Ticker, storages ...*aggregateStorage) {
+	for range ticker.C {
+		if control.Paused() {
+			continue
+		}
+		for _, storage := range storages {
+			storage.Schedule()
+		}
+	}
+}
+
+// ResetIntervals applies the flush intervals of Conf to running tickers
+func (control *flushControl) ResetIntervals() {
+	conf := Conf()
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if control.dailyTicker != nil {
+		control.dailyTicker.Reset(time.Duration(conf.FlushToDbInterval) * time.Second)
+		control.totalsTicker.Reset(time.Duration(conf.FlushTotalsInterval) * time.Second)
+	}
+}
+
+func (control *flushControl) Paused() bool {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	return control.paused
+}
+
+func (control *flushControl) setPaused(paused bool) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if paused && !control.paused {
+		control.pausedAt = time.Now()
+	}
+	control.paused = paused
+}
+
+func (control *flushControl) status() gin.H {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	status := gin.H{"paused": control.paused}
+	if control.paused {
+		status["pausedAt"] = control.pausedAt
+	}
+	return status
+}
+
+// selectedStorages returns the storage named by the storage query parameter, or all of them
+func selectedStorages(c *gin.Context) (map[string]bufferedStorage, bool) {
+	storages := storagesByName()
+	name := c.Query("storage")
+	if name == "" {
+		return storages, true
+	}
+	storage, ok := storages[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown storage " + name})
+		return nil, false
+	}
+	return map[string]bufferedStorage{name: storage}, true
+}
+
+// flushHandler serves POST /admin/flush?storage=DailyMetrics, flushing one or all storages now
+func flushHandler(c *gin.Context) {
+	storages, ok := selectedStorages(c)
+	if !ok {
+		return
+	}
+	flushed := make(map[string]int, len(storages))
+	for name, storage := range storages {
+		flushed[name] = storage.FlushToDb()
+	}
+	c.JSON(http.StatusOK, gin.H{"flushed": flushed})
+}
+
+func flushStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, FlushControl.status())
+}
+
+func pauseFlushHandler(c *gin.Context) {
+	FlushControl.setPaused(true)
+	c.JSON(http.StatusOK, FlushControl.status())
+}
+
+func resumeFlushHandler(c *gin.Context) {
+	FlushControl.setPaused(false)
+	c.JSON(http.StatusOK, FlushControl.status())
+}
+
+// buffersHandler serves GET /admin/buffers?storage=DailyMetrics&date=2017-07-14&limit=100, the rows
+// waiting for the next flush or being written per storage and date. limit caps the rows listed per date, 0 lists only the counts
+func buffersHandler(c *gin.Context) {
+	storages, ok := selectedStorages(c)
+	if !ok {
+		return
+	}
+	limit := 100
+	if c.Query("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(c.Query("limit")); err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number, 0 or more"})
+			return
+		}
+	}
+	dateKey := ""
+	if c.Query("date") != "" {
+		date, err := time.ParseInLocation("2006-01-02", c.Query("date"), time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "date must be YYYY-MM-DD"})
+			return
+		}
+		dateKey = date.Format("2006_01_02")
+	}
+
+	metricNames := make(map[int]string)
+	MCache.Range(func(name string, id int) bool {
+		metricNames[id] = name
+		return true
+	})
+	sliceKeys := make(map[int]string)
+	SlicesCache.Range(func(key string, id int) bool {
+		sliceKeys[id] = key
+		return true
+	})
+
+	result := make(map[string]gin.H, len(storages))
+	for name, storage := range storages {
+		dates := gin.H{}
+		for date, buffered := range storage.Snapshot(limit) {
+			if dateKey != "" && date != dateKey {
+				continue
+			}
+			for i := range buffered.Values {
+				row := &buffered.Values[i]
+				row.Metric = metricNames[row.MetricId]
+				if row.SliceId != 0 {
+					row.Category, row.Slice = splitSliceKey(sliceKeys[row.SliceId])
+				}
+			}
+			dates[date] = buffered
+		}
+		result[name] = dates
+	}
+	c.JSON(http.StatusOK, gin.H{"paused": FlushControl.Paused(), "storages": result})
+}
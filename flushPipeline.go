@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFlushConcurrency = 2
+	defaultFlushTimeout     = 60
+)
+
+// flushJob holds rows taken from a storage until they are written. done is closed after the write
+type flushJob struct {
+	days    map[int32]map[aggregateKey]aggregateValue
+	rows    int
+	takenAt time.Time
+	done    chan struct{}
+	err     error
+}
+
+func (job *flushJob) merge(days map[int32]map[aggregateKey]aggregateValue) {
+	for day, values := range days {
+		rows, ok := job.days[day]
+		if !ok {
+			job.days[day] = values
+			job.rows += len(values)
+			continue
+		}
+		for key, value := range values {
+			sum, ok := rows[key]
+			if !ok {
+				job.rows++
+			}
+			sum.value += value.value
+			sum.valueFloat += value.valueFloat
+			rows[key] = sum
+		}
+	}
+}
+
+// flushPipeline writes the flushed rows in the background with Conf.Flush.Concurrency writers, so
+// neither the tickers nor Inc wait for the database. A storage is written by one writer at a time;
+// rows taken while its previous rows are still pending or being written are coalesced into one job
+type flushPipeline struct {
+	once  sync.Once
+	queue chan *aggregateStorage
+	//held for reading by every write, Pause holds it for writing
+	writes sync.RWMutex
+}
+
+var FlushPipeline flushPipeline
+
+func (pipeline *flushPipeline) start() {
+	pipeline.once.Do(func() {
+		concurrency := Conf().Flush.Concurrency
+		if concurrency <= 0 {
+			concurrency = defaultFlushConcurrency
+		}
+		//a storage is queued at most once
+		pipeline.queue = make(chan *aggregateStorage, len(storagesByName()))
+		for i := 0; i < concurrency; i++ {
+			go func() {
+				for storage := range pipeline.queue {
+					storage.writePending()
+				}
+			}()
+		}
+	})
+}
+
+// Pause waits for the running writes to finish and holds the next ones until Resume,
+// for admin operations rewriting rows flushes could write concurrently
+func (pipeline *flushPipeline) Pause() {
+	pipeline.writes.Lock()
+}
+
+func (pipeline *flushPipeline) Resume() {
+	pipeline.writes.Unlock()
+}
+
+func flushTimeout() time.Duration {
+	timeout := Conf().Flush.Timeout
+	if timeout <= 0 {
+		timeout = defaultFlushTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// Schedule takes the buffered rows for the next write and returns the job they will be written
+// by, nil when nothing is buffered, pending or being written
+func (storage *aggregateStorage) Schedule() *flushJob {
+	FlushPipeline.start()
+	days := storage.agg.Take()
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if len(days) == 0 {
+		if storage.pending != nil {
+			return storage.pending
+		}
+		if storage.writing == nil {
+			//nothing to write is a successful flush
+			FlushHealth.Record(storage.name, nil)
+		}
+		return storage.writing
+	}
+	if storage.pending != nil {
+		storage.pending.merge(days)
+		coalescedFlushes.WithLabelValues(storage.name).Inc()
+		return storage.pending
+	}
+	storage.pending = &flushJob{days: map[int32]map[aggregateKey]aggregateValue{}, takenAt: time.Now(), done: make(chan struct{})}
+	storage.pending.merge(days)
+	if storage.writing == nil {
+		FlushPipeline.queue <- storage
+	}
+	return storage.pending
+}
+
+// FlushToDb schedules a flush and waits until the rows taken so far are written, returning the rows
+// written by the job
+func (storage *aggregateStorage) FlushToDb() int {
+	job := storage.Schedule()
+	if job == nil {
+		return 0
+	}
+	<-job.done
+	return job.rows
+}
+
+// writePending writes the pending jobs of the storage until none is left
+func (storage *aggregateStorage) writePending() {
+	storage.mu.Lock()
+	for storage.pending != nil {
+		job := storage.pending
+		storage.pending = nil
+		storage.writing = job
+		storage.mu.Unlock()
+
+		FlushPipeline.writes.RLock()
+		ctx, cancel := context.WithTimeout(context.Background(), flushTimeout())
+		job.err = storage.write(ctx, job)
+		cancel()
+		FlushPipeline.writes.RUnlock()
+
+		storage.mu.Lock()
+		storage.writing = nil
+		close(job.done)
+	}
+	storage.mu.Unlock()
+}
+
+// Lag returns how long the oldest rows taken by a flush have been waiting to be written, 0 when none is
+func (storage *aggregateStorage) Lag() time.Duration {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.writing != nil {
+		return time.Since(storage.writing.takenAt)
+	}
+	if storage.pending != nil {
+		return time.Since(storage.pending.takenAt)
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDbPingTimeout = 2
+	checkOk              = "ok"
+	checkFail            = "fail"
+	//flushes paused through /admin/flush/pause, the flush age is not checked
+	checkPaused = "paused"
+)
+
+var startedAt = time.Now()
+
+// flushHealth remembers the last successful flush and the last error of every storage
+type flushHealth struct {
+	mu          sync.Mutex
+	lastSuccess map[string]time.Time
+	lastError   map[string]string
+}
+
+var FlushHealth flushHealth
+
+// Record stores the outcome of a flush of the storage, err is nil for a successful one
+func (health *flushHealth) Record(storage string, err error) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.lastSuccess == nil {
+		health.lastSuccess = make(map[string]time.Time)
+		health.lastError = make(map[string]string)
+	}
+	if err != nil {
+		health.lastError[storage] = err.Error()
+		return
+	}
+	health.lastSuccess[storage] = time.Now()
+	delete(health.lastError, storage)
+}
+
+// LastSuccess returns the time of the last successful flush, the start of the process before the first one
+func (health *flushHealth) LastSuccess(storage string) (time.Time, string) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	last, ok := health.lastSuccess[storage]
+	if !ok {
+		last = startedAt
+	}
+	return last, health.lastError[storage]
+}
+
+// flushInterval returns the ticker interval of the storage in seconds
+func flushInterval(storage string) int {
+	conf := Conf()
+	if storage == "DailyMetricTotals" || storage == "DailySliceTotals" {
+		return conf.FlushTotalsInterval
+	}
+	return conf.FlushToDbInterval
+}
+
+// maxFlushAge returns how old the last successful flush of the storage may be, Conf.Health.MaxFlushAge
+// or three flush intervals
+func maxFlushAge(storage string) time.Duration {
+	seconds := Conf().Health.MaxFlushAge
+	if seconds <= 0 {
+		seconds = 3 * flushInterval(storage)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func checkDatabase() gin.H {
+	timeout := Conf().Health.DbPingTimeout
+	if timeout <= 0 {
+		timeout = defaultDbPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	startTime := time.Now()
+	if err := Db.PingContext(ctx); err != nil {
+		return gin.H{"status": checkFail, "error": err.Error()}
+	}
+	return gin.H{"status": checkOk, "latencyMs": time.Since(startTime).Milliseconds()}
+}
+
+func checkFlush(storage string) gin.H {
+	last, lastError := FlushHealth.LastSuccess(storage)
+	age := time.Since(last)
+	check := gin.H{"status": checkOk, "lastSuccess": last, "ageSeconds": int64(age.Seconds())}
+	if lastError != "" {
+		check["lastError"] = lastError
+	}
+	if FlushControl.Paused() {
+		check["status"] = checkPaused
+	} else if age > maxFlushAge(storage) {
+		check["status"] = checkFail
+	}
+	return check
+}
+
+func checkBuffers() gin.H {
+	conf := Conf()
+	rows := 0
+	byStorage := gin.H{}
+	for name, storage := range storagesByName() {
+		storageRows := storage.Len()
+		byStorage[name] = storageRows
+		rows += storageRows
+	}
+	check := gin.H{"status": checkOk, "rows": rows, "byStorage": byStorage, "maxRows": conf.Health.MaxBufferedRows}
+	if conf.Health.MaxBufferedRows > 0 && rows > conf.Health.MaxBufferedRows {
+		check["status"] = checkFail
+	}
+	return check
+}
+
+// healthzHandler reports that the process is alive
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":        checkOk,
+		"uptimeSeconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+// readyzHandler checks the database, the age of the last successful flush of every storage and
+// the buffered rows, and answers 503 when any check fails. Paused flushes are reported, not failed,
+// so a maintenance pause does not take the instance out of the load balancer
+func readyzHandler(c *gin.Context) {
+	checks := gin.H{"database": checkDatabase(), "buffers": checkBuffers()}
+	for name := range storagesByName() {
+		checks["flush"+name] = checkFlush(name)
+	}
+	status, code := checkOk, http.StatusOK
+	for _, check := range checks {
+		switch check.(gin.H)["status"] {
+		case checkOk:
+		case checkPaused:
+			if status == checkOk {
+				status = checkPaused
+			}
+		default:
+			status, code = checkFail, http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
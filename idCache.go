@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// idCache maps dictionary keys (metric names, slice category+name) to ids.
+// Cached ids are read without locking. Misses are resolved in batches, and a key that is already being
+// resolved by another goroutine is waited for instead of being queried again, so a burst of new names
+// costs one round-trip per batch and never blocks readers of known ids
+type idCache struct {
+	ids      sync.Map
+	mu       sync.Mutex
+	inflight map[string]*idFlight
+	resolve  func(keys []string) (map[string]int, error)
+}
+
+type idFlight struct {
+	done chan struct{}
+	id   int
+	err  error
+}
+
+func (cache *idCache) Get(key string) (int, bool) {
+	id, ok := cache.ids.Load(key)
+	if !ok {
+		return 0, false
+	}
+	return id.(int), true
+}
+
+func (cache *idCache) Set(key string, id int) {
+	cache.ids.Store(key, id)
+}
+
+func (cache *idCache) Delete(key string) {
+	cache.ids.Delete(key)
+}
+
+// Rename moves id from oldKey to newKey after update succeeded. update runs with the cache locked,
+// so misses of newKey wait for the rename instead of creating a new id
+func (cache *idCache) Rename(oldKey string, newKey string, id int, update func() error) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if err := update(); err != nil {
+		return err
+	}
+	cache.ids.Delete(oldKey)
+	cache.ids.Store(newKey, id)
+	return nil
+}
+
+// Reset replaces the whole content of the cache
+func (cache *idCache) Reset(ids map[string]int) {
+	cache.mu.Lock()
+	cache.ids.Range(func(key, _ interface{}) bool {
+		cache.ids.Delete(key)
+		return true
+	})
+	for key, id := range ids {
+		cache.ids.Store(key, id)
+	}
+	cache.mu.Unlock()
+}
+
+// Range calls f for every cached key until f returns false
+func (cache *idCache) Range(f func(key string, id int) bool) {
+	cache.ids.Range(func(key, id interface{}) bool {
+		return f(key.(string), id.(int))
+	})
+}
+
+// Resolve returns ids for all keys it could resolve. Unknown keys are looked up and created with
+// one batch; the error, if any, is about the keys missing from the result
+func (cache *idCache) Resolve(keys []string) (map[string]int, error) {
+	result := make(map[string]int, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if id, ok := cache.Get(key); ok {
+			result[key] = id
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	own := make(map[string]*idFlight)
+	waiting := make(map[string]*idFlight)
+	var ownKeys []string
+	cache.mu.Lock()
+	if cache.inflight == nil {
+		cache.inflight = make(map[string]*idFlight)
+	}
+	for _, key := range missing {
+		if _, ok := own[key]; ok {
+			continue
+		}
+		//stored while we were not holding the lock
+		if id, ok := cache.Get(key); ok {
+			result[key] = id
+			continue
+		}
+		if flight, ok := cache.inflight[key]; ok {
+			waiting[key] = flight
+			continue
+		}
+		flight := &idFlight{done: make(chan struct{})}
+		cache.inflight[key] = flight
+		own[key] = flight
+		ownKeys = append(ownKeys, key)
+	}
+	cache.mu.Unlock()
+
+	var resolveErr error
+	if len(ownKeys) > 0 {
+		ids, err := cache.resolve(ownKeys)
+		cache.mu.Lock()
+		for _, key := range ownKeys {
+			flight := own[key]
+			if id, ok := ids[key]; ok {
+				flight.id = id
+				cache.ids.Store(key, id)
+				result[key] = id
+			} else if err != nil {
+				flight.err = err
+			} else {
+				flight.err = errors.New("cannot resolve id of " + strings.Replace(key, sliceKeySeparator, ":", 1))
+			}
+			delete(cache.inflight, key)
+			close(flight.done)
+			if flight.err != nil && resolveErr == nil {
+				resolveErr = flight.err
+			}
+		}
+		cache.mu.Unlock()
+	}
+
+	for key, flight := range waiting {
+		<-flight.done
+		if flight.err != nil {
+			if resolveErr == nil {
+				resolveErr = flight.err
+			}
+			continue
+		}
+		result[key] = flight.id
+	}
+	return result, resolveErr
+}
+
+type metricsCache struct {
+	idCache
+}
+
+func (mc *metricsCache) GetMetricIdByName(metricName string) (int, error) {
+	if metricId, ok := mc.Get(metricName); ok {
+		return metricId, nil
+	}
+	ids, err := mc.Resolve([]string{metricName})
+	if err != nil {
+		return 0, err
+	}
+	return ids[metricName], nil
+}
+
+// sliceKeySeparator joins category and name into a slicesCache key, it cannot appear in either of them
+const sliceKeySeparator = "\x00"
+
+func sliceKey(category string, name string) string {
+	return category + sliceKeySeparator + name
+}
+
+func splitSliceKey(key string) (string, string) {
+	parts := strings.SplitN(key, sliceKeySeparator, 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+type slicesCache struct {
+	idCache
+}
+
+func (sc *slicesCache) GetSliceIdByCategoryAndName(category string, name string) (int, error) {
+	key := sliceKey(category, name)
+	if sliceId, ok := sc.Get(key); ok {
+		return sliceId, nil
+	}
+	ids, err := sc.Resolve([]string{key})
+	if err != nil {
+		return 0, err
+	}
+	return ids[key], nil
+}
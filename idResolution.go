@@ -0,0 +1,333 @@
+package main
+
+import (
+	"hash/crc32"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// MetricCrcCollisions and SliceCrcCollisions count lookups that found a different name behind the same
+// crc32 checksum, or behind the same name under the collation of tables not migrated to utf8_bin.
+// Checksum collisions still get their own ids, collation collisions are not resolved
+var MetricCrcCollisions int64
+var SliceCrcCollisions int64
+
+// collationError reports a name resolving to a row of another name equal to it under the collation.
+// Only that name stays unresolved, the rest of its batch is resolved
+type collationError string
+
+func (err collationError) Error() string {
+	return string(err)
+}
+
+// resolveMetricId returns the id of the metric, creating the row when it does not exist yet.
+// name_crc_32 is only an index: the full name is verified, so names sharing a checksum never merge
+func resolveMetricId(metricName string) (int, error) {
+	crc32name := crc32.ChecksumIEEE([]byte(metricName))
+	id, found, err := lookupMetricId(metricName, crc32name)
+	if err != nil || found {
+		return id, err
+	}
+
+	//create id
+	result, err := Db.Exec("INSERT IGNORE INTO metrics (name, name_crc_32) VALUES (?, ?)", metricName, crc32name)
+	if err != nil {
+		return 0, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 1 {
+		insertId, err := result.LastInsertId()
+		return int(insertId), err
+	}
+	//another instance inserted the same name first, metrics_name_unique kept its row
+	var storedName string
+	err = Db.QueryRow("SELECT id, name FROM metrics WHERE name=?", metricName).Scan(&id, &storedName)
+	if err != nil {
+		return 0, err
+	}
+	if storedName != metricName {
+		//equal only under utf8_unicode_ci, until `realmetric migrate` makes names binary
+		atomic.AddInt64(&MetricCrcCollisions, 1)
+		slog.Warn("Collation collision", "dictionary", "metrics", "metric", metricName, "other", storedName, "id", id)
+		return 0, collationError("metric " + metricName + " collides with " + storedName + " under the collation, run `realmetric migrate`")
+	}
+	return id, nil
+}
+
+func lookupMetricId(metricName string, crc32name uint32) (int, bool, error) {
+	rows, err := Db.Query("SELECT id, name FROM metrics WHERE name_crc_32=?", crc32name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return 0, false, err
+		}
+		if name == metricName {
+			return id, true, nil
+		}
+		atomic.AddInt64(&MetricCrcCollisions, 1)
+		slog.Warn("CRC32 collision", "dictionary", "metrics", "metric", metricName, "other", name, "id", id)
+	}
+	return 0, false, rows.Err()
+}
+
+// resolveSliceId is resolveMetricId for slices. The slices_category_name_unique key makes concurrent
+// inserts of the same slice from several instances end up in a single row
+func resolveSliceId(category string, name string) (int, error) {
+	crc32category := crc32.ChecksumIEEE([]byte(category))
+	crc32name := crc32.ChecksumIEEE([]byte(name))
+	id, found, err := lookupSliceId(category, name, crc32category, crc32name)
+	if err != nil || found {
+		return id, err
+	}
+
+	//create id
+	result, err := Db.Exec("INSERT IGNORE INTO slices (category, category_crc_32, name, name_crc_32) VALUES (?, ?, ?, ?)",
+		category, crc32category, name, crc32name)
+	if err != nil {
+		return 0, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 1 {
+		insertId, err := result.LastInsertId()
+		return int(insertId), err
+	}
+	var storedCategory, storedName string
+	err = Db.QueryRow("SELECT id, category, name FROM slices WHERE category=? AND name=?", category, name).
+		Scan(&id, &storedCategory, &storedName)
+	if err != nil {
+		return 0, err
+	}
+	if storedCategory != category || storedName != name {
+		atomic.AddInt64(&SliceCrcCollisions, 1)
+		slog.Warn("Collation collision", "dictionary", "slices", "category", category, "slice", name,
+			"otherCategory", storedCategory, "other", storedName, "id", id)
+		return 0, collationError("slice " + category + ":" + name + " collides with " + storedCategory + ":" + storedName +
+			" under the collation, run `realmetric migrate`")
+	}
+	return id, nil
+}
+
+func lookupSliceId(category string, sliceName string, crc32category uint32, crc32name uint32) (int, bool, error) {
+	rows, err := Db.Query("SELECT id, category, name FROM slices WHERE category_crc_32=? AND name_crc_32=?", crc32category, crc32name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var storedCategory, name string
+		if err := rows.Scan(&id, &storedCategory, &name); err != nil {
+			return 0, false, err
+		}
+		if storedCategory == category && name == sliceName {
+			return id, true, nil
+		}
+		atomic.AddInt64(&SliceCrcCollisions, 1)
+		slog.Warn("CRC32 collision", "dictionary", "slices", "category", category, "slice", sliceName,
+			"otherCategory", storedCategory, "other", name, "id", id)
+	}
+	return 0, false, rows.Err()
+}
+
+// resolveBatchSize limits the number of names per lookup and insert query of the batch resolvers
+const resolveBatchSize = 500
+
+// placeholderGroups returns "(?,?),(?,?)" for groups of size placeholders
+func placeholderGroups(groups int, size int) string {
+	group := "(" + strings.TrimSuffix(strings.Repeat("?,", size), ",") + ")"
+	return strings.TrimSuffix(strings.Repeat(group+",", groups), ",")
+}
+
+// resolveMetricIds resolves many metric names with a few queries: one lookup by checksum,
+// one INSERT IGNORE of the unknown names and one lookup by name for the inserted rows
+func resolveMetricIds(names []string) (map[string]int, error) {
+	ids := make(map[string]int, len(names))
+	var resolveErr error
+	for start := 0; start < len(names); start += resolveBatchSize {
+		end := start + resolveBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		if err := resolveMetricIdsBatch(names[start:end], ids); err != nil {
+			if _, collision := err.(collationError); !collision {
+				return ids, err
+			}
+			resolveErr = err
+		}
+	}
+	return ids, resolveErr
+}
+
+func resolveMetricIdsBatch(names []string, ids map[string]int) error {
+	wanted := make(map[string]bool, len(names))
+	crcs := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		wanted[name] = true
+		crcs = append(crcs, crc32.ChecksumIEEE([]byte(name)))
+	}
+	err := selectMetricIds("SELECT id, name FROM metrics WHERE name_crc_32 IN "+placeholderGroups(1, len(crcs)), crcs, wanted, ids, true)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	var args []interface{}
+	for _, name := range names {
+		if _, ok := ids[name]; !ok {
+			missing = append(missing, name)
+			args = append(args, name, crc32.ChecksumIEEE([]byte(name)))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	//create ids
+	if _, err := Db.Exec("INSERT IGNORE INTO metrics (name, name_crc_32) VALUES "+placeholderGroups(len(missing), 2), args...); err != nil {
+		return err
+	}
+	nameArgs := make([]interface{}, 0, len(missing))
+	for _, name := range missing {
+		nameArgs = append(nameArgs, name)
+	}
+	err = selectMetricIds("SELECT id, name FROM metrics WHERE name IN "+placeholderGroups(1, len(nameArgs)), nameArgs, wanted, ids, false)
+	if err != nil {
+		return err
+	}
+	//names equal to an existing one only by collation are left unresolved
+	var collisionErr error
+	for _, name := range missing {
+		if _, ok := ids[name]; ok {
+			continue
+		}
+		id, err := resolveMetricId(name)
+		if err != nil {
+			collisionErr = err
+			continue
+		}
+		ids[name] = id
+	}
+	return collisionErr
+}
+
+func selectMetricIds(query string, args []interface{}, wanted map[string]bool, ids map[string]int, reportCollisions bool) error {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		if wanted[name] {
+			ids[name] = id
+		} else if reportCollisions {
+			atomic.AddInt64(&MetricCrcCollisions, 1)
+			slog.Warn("CRC32 collision with a new metric", "dictionary", "metrics", "metric", name, "id", id)
+		}
+	}
+	return rows.Err()
+}
+
+// resolveSliceIds is resolveMetricIds for slicesCache keys built by sliceKey
+func resolveSliceIds(keys []string) (map[string]int, error) {
+	ids := make(map[string]int, len(keys))
+	var resolveErr error
+	for start := 0; start < len(keys); start += resolveBatchSize {
+		end := start + resolveBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := resolveSliceIdsBatch(keys[start:end], ids); err != nil {
+			if _, collision := err.(collationError); !collision {
+				return ids, err
+			}
+			resolveErr = err
+		}
+	}
+	return ids, resolveErr
+}
+
+func resolveSliceIdsBatch(keys []string, ids map[string]int) error {
+	wanted := make(map[string]bool, len(keys))
+	crcs := make([]interface{}, 0, len(keys)*2)
+	for _, key := range keys {
+		wanted[key] = true
+		category, name := splitSliceKey(key)
+		crcs = append(crcs, crc32.ChecksumIEEE([]byte(category)), crc32.ChecksumIEEE([]byte(name)))
+	}
+	err := selectSliceIds("SELECT id, category, name FROM slices WHERE (category_crc_32, name_crc_32) IN "+
+		placeholderGroups(len(keys), 2), crcs, wanted, ids, true)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	var args []interface{}
+	var names []interface{}
+	for _, key := range keys {
+		if _, ok := ids[key]; !ok {
+			category, name := splitSliceKey(key)
+			missing = append(missing, key)
+			args = append(args, category, crc32.ChecksumIEEE([]byte(category)), name, crc32.ChecksumIEEE([]byte(name)))
+			names = append(names, category, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	//create ids
+	_, err = Db.Exec("INSERT IGNORE INTO slices (category, category_crc_32, name, name_crc_32) VALUES "+
+		placeholderGroups(len(missing), 4), args...)
+	if err != nil {
+		return err
+	}
+	err = selectSliceIds("SELECT id, category, name FROM slices WHERE (category, name) IN "+
+		placeholderGroups(len(missing), 2), names, wanted, ids, false)
+	if err != nil {
+		return err
+	}
+	var collisionErr error
+	for _, key := range missing {
+		if _, ok := ids[key]; ok {
+			continue
+		}
+		category, name := splitSliceKey(key)
+		id, err := resolveSliceId(category, name)
+		if err != nil {
+			collisionErr = err
+			continue
+		}
+		ids[key] = id
+	}
+	return collisionErr
+}
+
+func selectSliceIds(query string, args []interface{}, wanted map[string]bool, ids map[string]int, reportCollisions bool) error {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var category, name string
+		if err := rows.Scan(&id, &category, &name); err != nil {
+			return err
+		}
+		key := sliceKey(category, name)
+		if wanted[key] {
+			ids[key] = id
+		} else if reportCollisions {
+			atomic.AddInt64(&SliceCrcCollisions, 1)
+			slog.Warn("CRC32 collision with a new slice", "dictionary", "slices", "category", category, "slice", name, "id", id)
+		}
+	}
+	return rows.Err()
+}
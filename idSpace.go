@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// maxIdForColumnType returns the biggest id an unsigned integer column of the given COLUMN_TYPE can hold
+func maxIdForColumnType(columnType string) int64 {
+	switch {
+	case strings.HasPrefix(columnType, "tinyint"):
+		return 255
+	case strings.HasPrefix(columnType, "smallint"):
+		return 65535
+	case strings.HasPrefix(columnType, "mediumint"):
+		return 16777215
+	case strings.HasPrefix(columnType, "bigint"):
+		return 1<<63 - 1
+	default:
+		return 4294967295
+	}
+}
+
+// checkIdSpace warns when the ids of metrics or slices approach the capacity of the narrowest
+// metric_id/slice_id column among the aggregate tables, e.g. tables not migrated from smallint yet
+func checkIdSpace() {
+	tables, err := aggregateTables()
+	if err != nil {
+		slog.Error("Cannot check id space", "error", err)
+		return
+	}
+	limits := map[string]int64{"metric_id": maxIdForColumnType("int"), "slice_id": maxIdForColumnType("int")}
+	narrowTables := 0
+	for _, tableName := range tables {
+		columns, err := tableColumns(tableName)
+		if err != nil {
+			slog.Error("Cannot check id space", "table", tableName, "error", err)
+			return
+		}
+		narrow := false
+		for column := range limits {
+			columnType, ok := columns[column]
+			if !ok {
+				continue
+			}
+			if limit := maxIdForColumnType(columnType); limit < limits[column] {
+				limits[column] = limit
+			}
+			if strings.HasPrefix(columnType, "smallint") {
+				narrow = true
+			}
+		}
+		if narrow {
+			narrowTables++
+		}
+	}
+	if narrowTables > 0 {
+		slog.Warn("Tables still have smallint ids, run `realmetric migrate`", "tables", narrowTables)
+	}
+
+	threshold := Conf().IdSpaceWarningPercent
+	if threshold <= 0 {
+		threshold = 80
+	}
+	for dictionary, column := range map[string]string{"metrics": "metric_id", "slices": "slice_id"} {
+		var maxId int64
+		if err := Db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM " + dictionary).Scan(&maxId); err != nil {
+			slog.Error("Cannot check id space", "dictionary", dictionary, "error", err)
+			continue
+		}
+		limit := limits[column]
+		usedPercent := maxId * 100 / limit
+		if usedPercent >= int64(threshold) {
+			slog.Warn("Id space running out", "dictionary", dictionary, "column", column,
+				"usedPercent", usedPercent, "maxId", maxId, "limit", limit)
+		}
+	}
+}
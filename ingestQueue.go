@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultIngestQueueSize  = 1000
+	defaultMaxQueuedEvents  = 1000000
+	defaultMaxBodyBytes     = 10 << 20
+	defaultMaxDecompressed  = 100 << 20
+	defaultIngestRetryAfter = 5
+)
+
+var (
+	errQueueFull     = errors.New("ingestion queue is full")
+	errOverloaded    = errors.New("buffered rows over the limit, the database does not keep up")
+	errBatchTooLarge = errors.New("batch has more events than the queue can hold")
+	errDraining      = errors.New("ingestion is held by an admin operation")
+)
+
+type ingestBatch struct {
+	tracks   []Event
+	backfill bool
+	reserved int64
+}
+
+// ingestQueue hands received batches to a fixed pool of aggregation workers. Capacity is reserved
+// before a batch is decoded further, so sends never block and a full queue answers 429 instead of
+// piling up goroutines; buffers over Conf.Ingestion.MaxBufferedRows answer 503
+type ingestQueue struct {
+	batches       chan ingestBatch
+	queuedBatches int64
+	queuedEvents  int64
+	//1 while Drain holds the queue
+	draining int32
+}
+
+var Ingestion ingestQueue
+
+func (queue *ingestQueue) size() int64 {
+	conf := Conf()
+	if conf.Ingestion.QueueSize <= 0 {
+		return defaultIngestQueueSize
+	}
+	return int64(conf.Ingestion.QueueSize)
+}
+
+func (queue *ingestQueue) maxEvents() int64 {
+	conf := Conf()
+	if conf.Ingestion.MaxQueuedEvents <= 0 {
+		return defaultMaxQueuedEvents
+	}
+	return int64(conf.Ingestion.MaxQueuedEvents)
+}
+
+// Start launches Conf.Ingestion.Workers aggregation workers, one per CPU by default
+func (queue *ingestQueue) Start() {
+	workers := Conf().Ingestion.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queue.batches = make(chan ingestBatch, queue.size())
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			for batch := range queue.batches {
+				aggregateEvents(batch.tracks, batch.backfill, worker)
+				queue.Release(batch.reserved)
+			}
+		}(i)
+	}
+}
+
+// Reserve takes room for a batch of events, Submit or Release must follow a successful Reserve
+func (queue *ingestQueue) Reserve(events int) error {
+	if int64(events) > queue.maxEvents() {
+		return errBatchTooLarge
+	}
+	if limit := Conf().Ingestion.MaxBufferedRows; limit > 0 && bufferedRows() > limit {
+		return errOverloaded
+	}
+	//counted before checking draining, so Drain either sees the batch or the batch sees Drain
+	if atomic.AddInt64(&queue.queuedBatches, 1) > queue.size() {
+		atomic.AddInt64(&queue.queuedBatches, -1)
+		return errQueueFull
+	}
+	if atomic.LoadInt32(&queue.draining) == 1 {
+		atomic.AddInt64(&queue.queuedBatches, -1)
+		return errDraining
+	}
+	if atomic.AddInt64(&queue.queuedEvents, int64(events)) > queue.maxEvents() {
+		atomic.AddInt64(&queue.queuedEvents, -int64(events))
+		atomic.AddInt64(&queue.queuedBatches, -1)
+		return errQueueFull
+	}
+	aggregateQueueDepth.Inc()
+	return nil
+}
+
+// Submit queues the tracks of a batch reserved for reserved events
+func (queue *ingestQueue) Submit(tracks []Event, backfill bool, reserved int) {
+	queue.batches <- ingestBatch{tracks: tracks, backfill: backfill, reserved: int64(reserved)}
+}
+
+// Release gives back the room of a batch
+func (queue *ingestQueue) Release(reserved int64) {
+	atomic.AddInt64(&queue.queuedEvents, -reserved)
+	atomic.AddInt64(&queue.queuedBatches, -1)
+	aggregateQueueDepth.Dec()
+}
+
+// Drain refuses new batches until Resume and waits until the reserved and queued ones are aggregated
+func (queue *ingestQueue) Drain() {
+	atomic.StoreInt32(&queue.draining, 1)
+	for atomic.LoadInt64(&queue.queuedBatches) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (queue *ingestQueue) Resume() {
+	atomic.StoreInt32(&queue.draining, 0)
+}
+
+// Full reports whether no batch can be queued, checked before reading a request body
+func (queue *ingestQueue) Full() bool {
+	return atomic.LoadInt64(&queue.queuedBatches) >= queue.size()
+}
+
+func (queue *ingestQueue) QueuedEvents() int64 {
+	return atomic.LoadInt64(&queue.queuedEvents)
+}
+
+func bufferedRows() int {
+	rows := 0
+	for _, storage := range storagesByName() {
+		rows += storage.Len()
+	}
+	return rows
+}
+
+// rejectBatch answers a batch refused by the queue: 413 when it can never fit, 503 when the
+// buffers are over their limit or an admin operation holds ingestion, 429 when the queue is full, with Retry-After for the last two
+func rejectBatch(c *gin.Context, err error) {
+	status := http.StatusTooManyRequests
+	reason := "queueFull"
+	switch err {
+	case errBatchTooLarge:
+		status = http.StatusRequestEntityTooLarge
+		reason = "tooLarge"
+	case errOverloaded:
+		status = http.StatusServiceUnavailable
+		reason = "overloaded"
+	case errDraining:
+		status = http.StatusServiceUnavailable
+		reason = "draining"
+	}
+	ingestRejectedBatches.WithLabelValues(reason).Inc()
+	if status != http.StatusRequestEntityTooLarge {
+		retryAfter := Conf().Ingestion.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultIngestRetryAfter
+		}
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+	}
+	c.JSON(status, gin.H{"createdEvents": 0, "error": err.Error()})
+}
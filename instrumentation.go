@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+// rejection reasons of realmetric_events_rejected_total, besides RejectTooLate and RejectInFuture
+const (
+	RejectInvalidMetric = "invalidMetric"
+	RejectBlacklisted   = "blacklisted"
+	RejectRegistry      = "registry"
+	RejectInvalidValue  = "invalidValue"
+	RejectNoMetricId    = "noMetricId"
+	RejectDuplicate     = "duplicate"
+)
+
+var (
+	eventsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realmetric_events_received_total",
+		Help: "Events received by /track and /backfill.",
+	})
+	eventsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realmetric_events_accepted_total",
+		Help: "Events aggregated into the storages.",
+	})
+	eventsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realmetric_events_rejected_total",
+		Help: "Events dropped before aggregation, by reason.",
+	}, []string{"reason"})
+	trackDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "realmetric_track_duration_seconds",
+		Help:    "Time to read, decode and enqueue a /track batch.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	aggregateQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "realmetric_aggregate_queue_depth",
+		Help: "Batches received but not aggregated yet.",
+	})
+	ingestRejectedBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realmetric_ingest_rejected_batches_total",
+		Help: "Batches refused by the ingestion queue, by reason (queueFull, overloaded, tooLarge).",
+	}, []string{"reason"})
+	ingestQueuedEvents = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "realmetric_ingest_queued_events",
+		Help: "Events reserved in the ingestion queue.",
+	}, func() float64 { return float64(Ingestion.QueuedEvents()) })
+	flushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "realmetric_flush_duration_seconds",
+		Help:    "Duration of FlushToDb, by storage.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"storage"})
+	flushRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realmetric_flush_rows_total",
+		Help: "Rows written by FlushToDb, by storage.",
+	}, []string{"storage"})
+	coalescedFlushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realmetric_flush_coalesced_total",
+		Help: "Flushes merged into a pending write of the same storage, by storage.",
+	}, []string{"storage"})
+	insertErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "realmetric_insert_errors_total",
+		Help: "Failed statements of InsertIncrementBatch.",
+	})
+	idCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "realmetric_id_cache_lookups_total",
+		Help: "Lookups of the metric and slice ids of received events, by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+	metricCacheHits   = idCacheLookups.WithLabelValues("metrics", "hit")
+	metricCacheMisses = idCacheLookups.WithLabelValues("metrics", "miss")
+	sliceCacheHits    = idCacheLookups.WithLabelValues("slices", "hit")
+	sliceCacheMisses  = idCacheLookups.WithLabelValues("slices", "miss")
+)
+
+// stateCollector exports counters and sizes kept by the rest of the code when scraped
+type stateCollector struct {
+	bufferedRows  *prometheus.Desc
+	flushLag      *prometheus.Desc
+	crcCollisions *prometheus.Desc
+	foldedSlices  *prometheus.Desc
+}
+
+func newStateCollector() *stateCollector {
+	return &stateCollector{
+		bufferedRows: prometheus.NewDesc("realmetric_storage_buffered_rows",
+			"Rows buffered in memory, by storage.", []string{"storage"}, nil),
+		flushLag: prometheus.NewDesc("realmetric_flush_lag_seconds",
+			"Age of the oldest flushed rows not written yet, by storage.", []string{"storage"}, nil),
+		crcCollisions: prometheus.NewDesc("realmetric_crc_collisions_total",
+			"Id lookups that found another name behind the same crc, by dictionary.", []string{"dictionary"}, nil),
+		foldedSlices: prometheus.NewDesc("realmetric_folded_slices_total",
+			"Slices folded into "+otherSliceName+" by the cardinality limits, by category of Cardinality.CategoryLimits, "+
+				otherSliceName+" for the rest.", []string{"category"}, nil),
+	}
+}
+
+func (collector *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.bufferedRows
+	ch <- collector.flushLag
+	ch <- collector.crcCollisions
+	ch <- collector.foldedSlices
+}
+
+func (collector *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, storage := range storagesByName() {
+		ch <- prometheus.MustNewConstMetric(collector.bufferedRows, prometheus.GaugeValue, float64(storage.Len()), name)
+		ch <- prometheus.MustNewConstMetric(collector.flushLag, prometheus.GaugeValue, storage.Lag().Seconds(), name)
+	}
+	ch <- prometheus.MustNewConstMetric(collector.crcCollisions, prometheus.CounterValue,
+		float64(atomic.LoadInt64(&MetricCrcCollisions)), "metrics")
+	ch <- prometheus.MustNewConstMetric(collector.crcCollisions, prometheus.CounterValue,
+		float64(atomic.LoadInt64(&SliceCrcCollisions)), "slices")
+	//categories come from clients, only the configured ones become series
+	byCategory, _ := Cardinality.Folded()
+	folded := make(map[string]int64)
+	for category, count := range byCategory {
+		if _, ok := Conf().Cardinality.CategoryLimits[category]; !ok {
+			category = otherSliceName
+		}
+		folded[category] += count
+	}
+	for category, count := range folded {
+		ch <- prometheus.MustNewConstMetric(collector.foldedSlices, prometheus.CounterValue, float64(count), category)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(eventsReceived, eventsAccepted, eventsRejected, trackDuration, aggregateQueueDepth,
+		ingestRejectedBatches, ingestQueuedEvents, flushDuration, flushRows, coalescedFlushes, insertErrors, idCacheLookups, newStateCollector())
+}
+
+func observeFlush(storage string, startTime time.Time, rows int) {
+	flushDuration.WithLabelValues(storage).Observe(time.Since(startTime).Seconds())
+	flushRows.WithLabelValues(storage).Add(float64(rows))
+}
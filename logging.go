@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogSampleInterval = 10
+	defaultLogSampleBurst    = 10
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel is the lowest level logged, set from Conf.Log.Level
+var logLevel slog.LevelVar
+
+func parseLogLevel(level string) (slog.Level, bool) {
+	if level == "" {
+		return slog.LevelInfo, true
+	}
+	value, ok := logLevels[strings.ToLower(level)]
+	return value, ok
+}
+
+func validLogFormat(format string) bool {
+	return format == "" || format == "json" || format == "logfmt"
+}
+
+// setupLogging makes the default logger, used by log/slog and the log package, write Conf.Log.Format
+// records to stderr at Conf.Log.Level and above
+func setupLogging(config LogConfig) {
+	level, _ := parseLogLevel(config.Level)
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, config.Format)))
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	options := &slog.HandlerOptions{Level: &logLevel}
+	if format == "logfmt" {
+		return slog.NewTextHandler(w, options)
+	}
+	return slog.NewJSONHandler(w, options)
+}
+
+// fatal logs an error and exits, for failures the service cannot start or run with
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logSampler lets through Conf.Log.SampleBurst records of a message per Conf.Log.SampleInterval seconds.
+// The first record of the next interval carries the number of records suppressed meanwhile
+type logSampler struct {
+	mu      sync.Mutex
+	windows map[string]*sampleWindow
+}
+
+type sampleWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+var sampler logSampler
+
+func (sampler *logSampler) allow(msg string, now time.Time) (bool, int) {
+	conf := Conf()
+	interval := conf.Log.SampleInterval
+	if interval <= 0 {
+		interval = defaultLogSampleInterval
+	}
+	burst := conf.Log.SampleBurst
+	if burst <= 0 {
+		burst = defaultLogSampleBurst
+	}
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	if sampler.windows == nil {
+		sampler.windows = make(map[string]*sampleWindow)
+	}
+	window, ok := sampler.windows[msg]
+	if !ok || now.Sub(window.start) >= time.Duration(interval)*time.Second {
+		suppressed := 0
+		if ok {
+			suppressed = window.suppressed
+		}
+		sampler.windows[msg] = &sampleWindow{start: now, count: 1}
+		return true, suppressed
+	}
+	if window.count >= burst {
+		window.suppressed++
+		return false, 0
+	}
+	window.count++
+	return true, 0
+}
+
+// logSampled logs a message repeated per event, like skipped events, within the sampling limits
+func logSampled(level slog.Level, msg string, args ...any) {
+	if !slog.Default().Enabled(context.Background(), level) {
+		return
+	}
+	ok, suppressed := sampler.allow(msg, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
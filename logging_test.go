@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogSamplerAllow(t *testing.T) {
+	type record struct {
+		msg        string
+		after      time.Duration
+		allowed    bool
+		suppressed int
+	}
+	tests := []struct {
+		name    string
+		records []record
+	}{
+		{"burst then suppressed", []record{
+			{"skip", 0, true, 0},
+			{"skip", time.Second, true, 0},
+			{"skip", 2 * time.Second, false, 0},
+			{"skip", 3 * time.Second, false, 0},
+		}},
+		{"next interval reports the suppressed count", []record{
+			{"skip", 0, true, 0},
+			{"skip", 0, true, 0},
+			{"skip", 0, false, 0},
+			{"skip", 0, false, 0},
+			{"skip", 0, false, 0},
+			{"skip", 5 * time.Second, true, 3},
+			{"skip", 6 * time.Second, true, 0},
+		}},
+		{"messages are sampled apart", []record{
+			{"skip", 0, true, 0},
+			{"skip", 0, true, 0},
+			{"skip", 0, false, 0},
+			{"reject", 0, true, 0},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{}
+			config.Log.SampleInterval = 5
+			config.Log.SampleBurst = 2
+			useConfig(t, config)
+			var sampler logSampler
+			start := time.Unix(1500000000, 0)
+			for i, record := range test.records {
+				allowed, suppressed := sampler.allow(record.msg, start.Add(record.after))
+				if allowed != record.allowed || suppressed != record.suppressed {
+					t.Errorf("record %d: allow(%q) = %v, %d, want %v, %d",
+						i, record.msg, allowed, suppressed, record.allowed, record.suppressed)
+				}
+			}
+		})
+	}
+}
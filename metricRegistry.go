@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	MetricTypeInt   = "int"
+	MetricTypeFloat = "float"
+)
+
+// MetricInfo is the registry entry of a metric, stored in the metrics table next to its name.
+// Type is the value mode of the metric, empty means Conf.FloatValueMetrics decides.
+// Events of a metric with AutoCreate false are accepted only while it is registered, as in strict mode
+type MetricInfo struct {
+	Id          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Unit        string   `json:"unit"`
+	Type        string   `json:"type"`
+	OwnerTeam   string   `json:"ownerTeam"`
+	Tags        []string `json:"tags"`
+	Registered  bool     `json:"registered"`
+	AutoCreate  bool     `json:"autoCreate"`
+}
+
+const defaultRegistryRefreshInterval = 60
+
+// metricRegistry keeps the registered metrics, and the unregistered ones with AutoCreate false, in memory
+// for the checks done per event. It is reloaded every Conf.Registry.RefreshInterval seconds; names missing
+// from it are looked up in the database once per reload when the checks depend on them
+type metricRegistry struct {
+	mu      sync.RWMutex
+	metrics map[string]MetricInfo
+	missed  map[string]bool
+}
+
+var MetricRegistry metricRegistry
+
+// Get returns the registry entry of a registered metric
+func (registry *metricRegistry) Get(metricName string) (MetricInfo, bool) {
+	info, ok := registry.entry(metricName)
+	return info, ok && info.Registered
+}
+
+func (registry *metricRegistry) entry(metricName string) (MetricInfo, bool) {
+	registry.mu.RLock()
+	info, ok := registry.metrics[metricName]
+	registry.mu.RUnlock()
+	return info, ok
+}
+
+// lookup reads the metric from the database, caching its id and its entry when it has one
+func (registry *metricRegistry) lookup(metricName string) (MetricInfo, bool) {
+	registry.mu.RLock()
+	missed := registry.missed[metricName]
+	registry.mu.RUnlock()
+	if missed {
+		return MetricInfo{}, false
+	}
+	info, found, err := selectMetricInfo(metricName)
+	if err != nil {
+		logSampled(slog.LevelError, "Cannot look up metric", "table", "metrics", "metric", metricName, "error", err)
+		return MetricInfo{}, false
+	}
+	if found {
+		MCache.Set(metricName, info.Id)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if found && (info.Registered || !info.AutoCreate) {
+		if registry.metrics == nil {
+			registry.metrics = make(map[string]MetricInfo)
+		}
+		registry.metrics[metricName] = info
+	} else {
+		if registry.missed == nil {
+			registry.missed = make(map[string]bool)
+		}
+		registry.missed[metricName] = true
+	}
+	return info, found
+}
+
+func (registry *metricRegistry) Set(info MetricInfo) {
+	registry.mu.Lock()
+	if registry.metrics == nil {
+		registry.metrics = make(map[string]MetricInfo)
+	}
+	registry.metrics[info.Name] = info
+	registry.mu.Unlock()
+}
+
+func (registry *metricRegistry) Remove(metricName string) {
+	registry.mu.Lock()
+	delete(registry.metrics, metricName)
+	registry.mu.Unlock()
+}
+
+// Unregister keeps the entry of a metric that may not be auto-created, unregistered, and removes the others
+func (registry *metricRegistry) Unregister(metricName string) {
+	registry.mu.Lock()
+	if info, ok := registry.metrics[metricName]; ok && !info.AutoCreate {
+		info.Registered = false
+		registry.metrics[metricName] = info
+	} else {
+		delete(registry.metrics, metricName)
+	}
+	registry.mu.Unlock()
+}
+
+// Reject returns why events of the metric are not accepted, or an empty string when they are
+func (registry *metricRegistry) Reject(metricName string) string {
+	conf := Conf()
+	info, ok := registry.entry(metricName)
+	if !ok {
+		if _, known := MCache.Get(metricName); conf.Registry.Strict || !conf.Registry.AutoCreate && !known {
+			//registered or created through another instance since the last reload
+			info, ok = registry.lookup(metricName)
+		}
+	}
+	if info.Registered {
+		return ""
+	}
+	if conf.Registry.Strict {
+		return "not registered"
+	}
+	if ok && !info.AutoCreate {
+		return "not registered and auto-create is disabled for the metric"
+	}
+	if !conf.Registry.AutoCreate {
+		if _, ok := MCache.Get(metricName); !ok {
+			return "unknown and auto-create is disabled"
+		}
+	}
+	return ""
+}
+
+// Start reloads the registry every Conf.Registry.RefreshInterval seconds
+func (registry *metricRegistry) Start() {
+	go func() {
+		for {
+			interval := Conf().Registry.RefreshInterval
+			if interval <= 0 {
+				interval = defaultRegistryRefreshInterval
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
+			warmupMetricRegistry()
+		}
+	}()
+}
+
+// IsFloatMetric reports the value mode of the metric: its registry type when set, the config otherwise
+func (registry *metricRegistry) IsFloatMetric(metricName string) bool {
+	if info, ok := registry.Get(metricName); ok && info.Type != "" {
+		return info.Type == MetricTypeFloat
+	}
+	return Conf().IsFloatMetric(metricName)
+}
+
+func warmupMetricRegistry() {
+	metrics, err := selectMetricInfos("WHERE registered = 1 OR auto_create = 0")
+	if err != nil {
+		//the metrics table misses the registry columns until `realmetric migrate` is run
+		slog.Error("Cannot load metric registry", "table", "metrics", "error", err)
+		return
+	}
+	entries := make(map[string]MetricInfo, len(metrics))
+	for _, info := range metrics {
+		entries[info.Name] = info
+	}
+	MetricRegistry.mu.Lock()
+	MetricRegistry.metrics = entries
+	MetricRegistry.missed = nil
+	MetricRegistry.mu.Unlock()
+}
+
+func selectMetricInfos(where string, args ...interface{}) ([]MetricInfo, error) {
+	rows, err := Db.Query("SELECT id, name, description, unit, value_type, owner_team, tags, registered, auto_create FROM metrics "+where+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metrics := []MetricInfo{}
+	for rows.Next() {
+		var info MetricInfo
+		var tags string
+		err := rows.Scan(&info.Id, &info.Name, &info.Description, &info.Unit, &info.Type, &info.OwnerTeam, &tags, &info.Registered, &info.AutoCreate)
+		if err != nil {
+			return nil, err
+		}
+		info.Tags = []string{}
+		if tags != "" {
+			if err := json.Unmarshal([]byte(tags), &info.Tags); err != nil {
+				slog.Warn("Skip invalid tags", "metric", info.Name, "error", err)
+			}
+		}
+		metrics = append(metrics, info)
+	}
+	return metrics, rows.Err()
+}
+
+func selectMetricInfo(metricName string) (MetricInfo, bool, error) {
+	metrics, err := selectMetricInfos("WHERE name = ?", metricName)
+	if err != nil || len(metrics) == 0 {
+		return MetricInfo{}, false, err
+	}
+	return metrics[0], true, nil
+}
+
+func validateMetricInfo(info MetricInfo) string {
+	r, err := regexp.Compile(Conf().MetricNameValidationRegexp)
+	if err != nil {
+		return err.Error()
+	}
+	if info.Name == "" || r.MatchString(info.Name) {
+		return "invalid metric name: " + info.Name
+	}
+	if info.Type != "" && info.Type != MetricTypeInt && info.Type != MetricTypeFloat {
+		return "type must be " + MetricTypeInt + " or " + MetricTypeFloat
+	}
+	return ""
+}
+
+// saveMetricInfo registers the metric, creating its row when no event created it yet
+func saveMetricInfo(info MetricInfo) (MetricInfo, error) {
+	if info.Tags == nil {
+		info.Tags = []string{}
+	}
+	tags, err := json.Marshal(info.Tags)
+	if err != nil {
+		return info, err
+	}
+	_, err = Db.Exec("INSERT INTO metrics (name, name_crc_32, description, unit, value_type, owner_team, tags, registered, auto_create) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?) ON DUPLICATE KEY UPDATE description = VALUES(description), unit = VALUES(unit), "+
+		"value_type = VALUES(value_type), owner_team = VALUES(owner_team), tags = VALUES(tags), registered = 1, "+
+		"auto_create = VALUES(auto_create)",
+		info.Name, crc32.ChecksumIEEE([]byte(info.Name)), info.Description, info.Unit, info.Type, info.OwnerTeam, string(tags), info.AutoCreate)
+	if err != nil {
+		return info, err
+	}
+	info.Id, err = MCache.GetMetricIdByName(info.Name)
+	if err != nil {
+		return info, err
+	}
+	info.Registered = true
+	MetricRegistry.Set(info)
+	return info, nil
+}
+
+func registryListHandler(c *gin.Context) {
+	where := ""
+	if c.Query("registered") == "1" {
+		where = "WHERE registered = 1"
+	}
+	metrics, err := selectMetricInfos(where)
+	if err != nil {
+		slog.Error("Cannot list metrics", "table", "metrics", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"metrics": metrics})
+}
+
+func registryGetHandler(c *gin.Context) {
+	info, found, err := selectMetricInfo(c.Param("name"))
+	if err != nil {
+		slog.Error("Cannot get metric", "table", "metrics", "metric", c.Param("name"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown metric " + c.Param("name")})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func registryCreateHandler(c *gin.Context) {
+	info := MetricInfo{AutoCreate: true}
+	if err := c.ShouldBindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if reason := validateMetricInfo(info); reason != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": reason})
+		return
+	}
+	if _, ok := MetricRegistry.Get(info.Name); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "metric " + info.Name + " is already registered"})
+		return
+	}
+	info, err := saveMetricInfo(info)
+	if err != nil {
+		slog.Error("Cannot register metric", "table", "metrics", "metric", info.Name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, info)
+}
+
+// registryUpdateHandler replaces the metadata of an existing metric, registering auto-created ones
+func registryUpdateHandler(c *gin.Context) {
+	info := MetricInfo{AutoCreate: true}
+	if err := c.ShouldBindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	info.Name = c.Param("name")
+	if reason := validateMetricInfo(info); reason != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": reason})
+		return
+	}
+	_, found, err := selectMetricInfo(info.Name)
+	if err == nil && !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown metric " + info.Name})
+		return
+	}
+	if err == nil {
+		info, err = saveMetricInfo(info)
+	}
+	if err != nil {
+		slog.Error("Cannot update metric", "table", "metrics", "metric", c.Param("name"), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// registryDeleteHandler unregisters the metric. Its id and data are kept, in strict mode or when its
+// AutoCreate is false its events are rejected
+func registryDeleteHandler(c *gin.Context) {
+	metricName := c.Param("name")
+	var id int
+	err := Db.QueryRow("SELECT id FROM metrics WHERE name = ?", metricName).Scan(&id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown metric " + metricName})
+		return
+	}
+	if err == nil {
+		_, err = Db.Exec("UPDATE metrics SET registered = 0 WHERE id = ?", id)
+	}
+	if err != nil {
+		slog.Error("Cannot unregister metric", "table", "metrics", "metric", metricName, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	MetricRegistry.Unregister(metricName)
+	c.JSON(http.StatusOK, gin.H{"id": id, "name": metricName, "registered": false})
+}
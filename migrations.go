@@ -0,0 +1,369 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+type migration struct {
+	name string
+	run  func() error
+}
+
+var migrations = []migration{
+	{name: "signed bigint values and value_float", run: migrateValueColumns},
+	{name: "int(10) metric_id and slice_id", run: migrateIdColumns},
+	{name: "binary metric and slice names", run: migrateBinaryNames},
+	{name: "unique slices category and name", run: migrateSlicesUniqueKey},
+	{name: "metric registry columns", run: migrateMetricRegistryColumns},
+}
+
+// runMigrations applies every migration to the tables created by older versions.
+// Migrations are idempotent, so running them twice is safe
+func runMigrations() error {
+	for _, m := range migrations {
+		slog.Info("Migration", "migration", m.name)
+		if err := m.run(); err != nil {
+			return err
+		}
+	}
+	slog.Info("Migrations done")
+	return nil
+}
+
+// requireMigrations refuses to start on tables created by older versions and not migrated yet,
+// which flushes and the metric registry would fail on
+func requireMigrations() {
+	pending, err := pendingMigrations()
+	if err != nil {
+		fatal("Cannot check migrations", "error", err)
+	}
+	if len(pending) > 0 {
+		examples := pending
+		if len(examples) > 10 {
+			examples = examples[:10]
+		}
+		fatal("Database not migrated, run `realmetric migrate` first", "tables", len(pending), "examples", examples)
+	}
+}
+
+// pendingMigrations returns the tables missing the columns of the migrations, with the columns, in one query
+func pendingMigrations() ([]string, error) {
+	rows, err := Db.Query("SELECT TABLE_NAME, COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() " +
+		"AND (TABLE_NAME LIKE 'daily\\_%' OR TABLE_NAME LIKE 'monthly\\_%' OR TABLE_NAME = 'metrics')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]map[string]string)
+	for rows.Next() {
+		var tableName, name, columnType string
+		if err := rows.Scan(&tableName, &name, &columnType); err != nil {
+			return nil, err
+		}
+		if tables[tableName] == nil {
+			tables[tableName] = make(map[string]string)
+		}
+		tables[tableName][name] = strings.ToLower(columnType)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var pending []string
+	for tableName, columns := range tables {
+		var missing []string
+		if tableName == "metrics" {
+			for _, column := range metricRegistryColumns {
+				if _, ok := columns[column.name]; !ok {
+					missing = append(missing, column.name)
+				}
+			}
+		} else if _, ok := columns["value"]; ok {
+			if _, ok := columns["value_float"]; !ok {
+				missing = append(missing, "value_float")
+			}
+			for _, column := range []string{"metric_id", "slice_id"} {
+				if columnType, ok := columns[column]; ok && maxIdForColumnType(columnType) < maxIdForColumnType("int") {
+					missing = append(missing, column+" int")
+				}
+			}
+		}
+		if len(missing) > 0 {
+			pending = append(pending, tableName+": "+strings.Join(missing, ", "))
+		}
+	}
+	sort.Strings(pending)
+	return pending, nil
+}
+
+// aggregateTables returns every daily_* and monthly_* table of the current database
+func aggregateTables() ([]string, error) {
+	rows, err := Db.Query("SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() " +
+		"AND (TABLE_NAME LIKE 'daily\\_%' OR TABLE_NAME LIKE 'monthly\\_%')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return nil, err
+		}
+		tables = append(tables, tableName)
+	}
+	return tables, rows.Err()
+}
+
+// tableColumns returns COLUMN_TYPE of every column of the table keyed by column name
+func tableColumns(tableName string) (map[string]string, error) {
+	rows, err := Db.Query("SELECT COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			return nil, err
+		}
+		columns[name] = strings.ToLower(columnType)
+	}
+	return columns, rows.Err()
+}
+
+// migrateValueColumns turns `value` int(11) unsigned into a signed bigint and adds `value_float`
+func migrateValueColumns() error {
+	tables, err := aggregateTables()
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tables {
+		columns, err := tableColumns(tableName)
+		if err != nil {
+			return err
+		}
+		valueType, ok := columns["value"]
+		if !ok {
+			continue
+		}
+		var alters []string
+		if !strings.HasPrefix(valueType, "bigint") || strings.Contains(valueType, "unsigned") {
+			alters = append(alters, "MODIFY `value` bigint(20) NOT NULL")
+		}
+		if _, ok := columns["value_float"]; !ok {
+			alters = append(alters, "ADD `value_float` double NOT NULL DEFAULT '0' AFTER `value`")
+		}
+		if len(alters) == 0 {
+			continue
+		}
+		slog.Info("Migrating", "table", tableName)
+		if _, err := Db.Exec("ALTER TABLE `" + tableName + "` " + strings.Join(alters, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateIdColumns widens metric_id and slice_id columns narrower than int to int(10) unsigned, matching the ids
+// of the metrics and slices tables; wider columns are left alone. Changing a column type copies the table, which
+// InnoDB cannot do with LOCK=NONE, so tables are rebuilt online by alterTableOnline while flushes go on
+func migrateIdColumns() error {
+	tables, err := aggregateTables()
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tables {
+		if strings.HasSuffix(tableName, "__new") || strings.HasSuffix(tableName, "__old") {
+			//left behind by an interrupted alterTableOnline, which drops it
+			continue
+		}
+		columns, err := tableColumns(tableName)
+		if err != nil {
+			return err
+		}
+		var alters []string
+		for _, column := range []string{"metric_id", "slice_id"} {
+			columnType, ok := columns[column]
+			if ok && maxIdForColumnType(columnType) < maxIdForColumnType("int") {
+				alters = append(alters, "MODIFY `"+column+"` int(10) unsigned NOT NULL")
+			}
+		}
+		if len(alters) == 0 {
+			continue
+		}
+		slog.Info("Migrating", "table", tableName)
+		if err := alterTableOnline(tableName, columns, alters); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onlineAlterChunk is the number of primary keys alterTableOnline copies per statement
+const onlineAlterChunk = 10000
+
+// alterTableOnline applies alters to the table without blocking its writes, the way online schema change tools
+// do: a shadow table gets the new definition, triggers mirror every write to the table into it while the rows are
+// copied by chunks of ids, then RENAME TABLE swaps both atomically. Rows already mirrored are newer than the copy,
+// which skips them. The database user needs the TRIGGER privilege, and SUPER or log_bin_trust_function_creators
+// with binary logging. An interrupted run leaves the table untouched and is cleaned up by the next one
+func alterTableOnline(tableName string, columns map[string]string, alters []string) error {
+	shadow, old := tableName+"__new", tableName+"__old"
+	triggers := map[string]string{tableName + "__ins": "INSERT", tableName + "__upd": "UPDATE", tableName + "__del": "DELETE"}
+	cleanup := func() {
+		for trigger := range triggers {
+			Db.Exec("DROP TRIGGER IF EXISTS `" + trigger + "`")
+		}
+		Db.Exec("DROP TABLE IF EXISTS `" + shadow + "`")
+		//RENAME TABLE is atomic, an old table left behind was already replaced
+		Db.Exec("DROP TABLE IF EXISTS `" + old + "`")
+	}
+	cleanup()
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	columnList := "`" + strings.Join(names, "`,`") + "`"
+	newValues := "NEW.`" + strings.Join(names, "`, NEW.`") + "`"
+	statements := []string{
+		"CREATE TABLE `" + shadow + "` LIKE `" + tableName + "`",
+		"ALTER TABLE `" + shadow + "` " + strings.Join(alters, ", "),
+	}
+	for trigger, event := range triggers {
+		action := "REPLACE INTO `" + shadow + "` (" + columnList + ") VALUES (" + newValues + ")"
+		if event == "DELETE" {
+			action = "DELETE FROM `" + shadow + "` WHERE `id` = OLD.`id`"
+		}
+		statements = append(statements, "CREATE TRIGGER `"+trigger+"` AFTER "+event+" ON `"+tableName+"` FOR EACH ROW "+action)
+	}
+	for _, statement := range statements {
+		if _, err := Db.Exec(statement); err != nil {
+			cleanup()
+			return err
+		}
+	}
+	var maxId sql.NullInt64
+	if err := Db.QueryRow("SELECT MAX(`id`) FROM `" + tableName + "`").Scan(&maxId); err != nil {
+		cleanup()
+		return err
+	}
+	for from := int64(0); from < maxId.Int64; from += onlineAlterChunk {
+		_, err := Db.Exec("INSERT IGNORE INTO `"+shadow+"` ("+columnList+") SELECT "+columnList+" FROM `"+tableName+"` "+
+			"WHERE `id` > ? AND `id` <= ?", from, from+onlineAlterChunk)
+		if err != nil {
+			cleanup()
+			return err
+		}
+	}
+	if _, err := Db.Exec("RENAME TABLE `" + tableName + "` TO `" + old + "`, `" + shadow + "` TO `" + tableName + "`"); err != nil {
+		cleanup()
+		return err
+	}
+	//the triggers go with the old table
+	_, err := Db.Exec("DROP TABLE `" + old + "`")
+	return err
+}
+
+// migrateBinaryNames switches metric names and slice categories and names to utf8_bin, so names that differ
+// only by case or trailing spaces are distinct for the unique keys instead of resolving to the same id
+func migrateBinaryNames() error {
+	for _, table := range []struct {
+		name    string
+		columns []string
+	}{{"metrics", []string{"name"}}, {"slices", []string{"category", "name"}}} {
+		var alters []string
+		for _, column := range table.columns {
+			var collation string
+			err := Db.QueryRow("SELECT COLLATION_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() "+
+				"AND TABLE_NAME = ? AND COLUMN_NAME = ?", table.name, column).Scan(&collation)
+			if err != nil {
+				return err
+			}
+			if collation != "utf8_bin" {
+				alters = append(alters, "MODIFY `"+column+"` varchar(255) COLLATE utf8_bin NOT NULL")
+			}
+		}
+		if len(alters) == 0 {
+			continue
+		}
+		slog.Info("Migrating", "table", table.name)
+		if _, err := Db.Exec("ALTER TABLE `" + table.name + "` " + strings.Join(alters, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSlicesUniqueKey adds slices_category_name_unique, which concurrent slice creation relies on.
+// Duplicate rows created before the key existed are reported and the key is left out until they are merged
+func migrateSlicesUniqueKey() error {
+	var count int
+	err := Db.QueryRow("SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() " +
+		"AND TABLE_NAME = 'slices' AND INDEX_NAME = 'slices_category_name_unique'").Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	rows, err := Db.Query("SELECT category, name, GROUP_CONCAT(id) FROM slices GROUP BY category, name HAVING COUNT(*) > 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	duplicates := 0
+	for rows.Next() {
+		var category, name, ids string
+		if err := rows.Scan(&category, &name, &ids); err != nil {
+			return err
+		}
+		slog.Warn("Duplicate slice", "table", "slices", "category", category, "slice", name, "ids", ids)
+		duplicates++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if duplicates > 0 {
+		slog.Warn("Skip slices_category_name_unique: merge the duplicate slices first", "table", "slices", "duplicates", duplicates)
+		return nil
+	}
+
+	_, err = Db.Exec("ALTER TABLE `slices` ADD UNIQUE KEY `slices_category_name_unique` (`category`,`name`)")
+	return err
+}
+
+var metricRegistryColumns = []struct{ name, definition string }{
+	{"description", "varchar(1024) COLLATE utf8_unicode_ci NOT NULL DEFAULT ''"},
+	{"unit", "varchar(64) COLLATE utf8_unicode_ci NOT NULL DEFAULT ''"},
+	{"value_type", "varchar(16) COLLATE utf8_unicode_ci NOT NULL DEFAULT ''"},
+	{"owner_team", "varchar(255) COLLATE utf8_unicode_ci NOT NULL DEFAULT ''"},
+	{"tags", "varchar(1024) COLLATE utf8_unicode_ci NOT NULL DEFAULT ''"},
+	{"registered", "tinyint(1) NOT NULL DEFAULT '0'"},
+	{"auto_create", "tinyint(1) NOT NULL DEFAULT '1'"},
+}
+
+// migrateMetricRegistryColumns adds the metadata columns of the metric registry to the metrics table
+func migrateMetricRegistryColumns() error {
+	columns, err := tableColumns("metrics")
+	if err != nil {
+		return err
+	}
+	var alters []string
+	for _, column := range metricRegistryColumns {
+		if _, ok := columns[column.name]; !ok {
+			alters = append(alters, "ADD `"+column.name+"` "+column.definition)
+		}
+	}
+	if len(alters) == 0 {
+		return nil
+	}
+	slog.Info("Migrating", "table", "metrics")
+	_, err = Db.Exec("ALTER TABLE `metrics` " + strings.Join(alters, ", "))
+	return err
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BlacklistMetric = "metric"
+	BlacklistSlice  = "slice"
+)
+
+// blacklist holds the metric names and slices whose events are dropped, loaded from the blacklist table
+type blacklist struct {
+	mu      sync.RWMutex
+	metrics map[string]struct{}
+	slices  map[string]struct{}
+}
+
+var Blacklist blacklist
+
+func (list *blacklist) HasMetric(metricName string) bool {
+	list.mu.RLock()
+	_, ok := list.metrics[metricName]
+	list.mu.RUnlock()
+	return ok
+}
+
+func (list *blacklist) HasSlice(category string, name string) bool {
+	list.mu.RLock()
+	_, ok := list.slices[sliceKey(category, name)]
+	list.mu.RUnlock()
+	return ok
+}
+
+func (list *blacklist) set(kind string, category string, name string) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if list.metrics == nil {
+		list.metrics = make(map[string]struct{})
+		list.slices = make(map[string]struct{})
+	}
+	if kind == BlacklistMetric {
+		list.metrics[name] = struct{}{}
+	} else {
+		list.slices[sliceKey(category, name)] = struct{}{}
+	}
+}
+
+// Add stores the entry in the blacklist table and drops its events from now on
+func (list *blacklist) Add(kind string, category string, name string) error {
+	_, err := Db.Exec("INSERT IGNORE INTO blacklist (kind, category, name) VALUES (?, ?, ?)", kind, category, name)
+	if err != nil {
+		return err
+	}
+	list.set(kind, category, name)
+	return nil
+}
+
+func warmupBlacklist() {
+	rows, err := Db.Query("SELECT kind, category, name FROM blacklist")
+	if err != nil {
+		fatal("Cannot load blacklist", "table", "blacklist", "error", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, category, name string
+		if err := rows.Scan(&kind, &category, &name); err != nil {
+			slog.Warn("Skip unresolved row", "table", "blacklist", "error", err)
+			continue
+		}
+		Blacklist.set(kind, category, name)
+	}
+}
+
+// purgeRequest selects rows to delete: a metric, a slice (category and name), or the slices of a metric
+// in a category. Zero From/To leave the date range open
+type purgeRequest struct {
+	Metric    string
+	Category  string
+	Name      string
+	From      time.Time
+	To        time.Time
+	Blacklist bool
+}
+
+type purgedTable struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+}
+
+type purgeReport struct {
+	Tables     []purgedTable `json:"tables"`
+	Dictionary bool          `json:"dictionaryRowDeleted"`
+	Blacklist  bool          `json:"blacklisted"`
+}
+
+func (request purgeRequest) sliceOnly() bool {
+	return request.Category != ""
+}
+
+func (request purgeRequest) validate() error {
+	if request.Metric == "" && request.Category == "" {
+		return errors.New("a metric or a slice category is required")
+	}
+	if request.Metric == "" && request.Name == "" {
+		return errors.New("a slice name is required without a metric")
+	}
+	if request.Blacklist && request.Metric != "" && request.Category != "" {
+		return errors.New("only a metric or a slice can be blacklisted")
+	}
+	if !request.From.IsZero() && !request.To.IsZero() && request.To.Before(request.From) {
+		return errors.New("to is before from")
+	}
+	return nil
+}
+
+func (request purgeRequest) allDates() bool {
+	return request.From.IsZero() && request.To.IsZero()
+}
+
+func (request purgeRequest) inRange(date time.Time) bool {
+	return (request.From.IsZero() || !date.Before(request.From)) && (request.To.IsZero() || !date.After(request.To))
+}
+
+// purge deletes the selected rows from the daily and monthly tables. Without a date range the
+// metric or slice is deleted from its dictionary table and the caches as well
+func purge(request purgeRequest) (purgeReport, error) {
+	report := purgeReport{Tables: []purgedTable{}}
+	if err := request.validate(); err != nil {
+		return report, err
+	}
+	var conditions []string
+	var args []interface{}
+	metricId, sliceId := 0, 0
+	var err error
+	if request.Metric != "" {
+		if metricId, err = storedMetricId(request.Metric); err != nil {
+			return report, err
+		}
+		conditions = append(conditions, "`metric_id` = ?")
+		args = append(args, metricId)
+	}
+	var composites []compositeSlice
+	if request.Category != "" {
+		if composites, err = compositeSlices(request.Category, request.Name); err != nil {
+			return report, err
+		}
+	}
+	compositeIds := make([]interface{}, 0, len(composites))
+	for _, composite := range composites {
+		compositeIds = append(compositeIds, composite.id)
+	}
+	if request.Name != "" {
+		if sliceId, err = storedSliceId(request.Category, request.Name); err != nil {
+			return report, err
+		}
+		conditions = append(conditions, "`slice_id` IN "+placeholderGroups(1, 1+len(compositeIds)))
+		args = append(append(args, sliceId), compositeIds...)
+	} else if request.Category != "" {
+		condition := "`slice_id` IN (SELECT id FROM slices WHERE category = ?)"
+		if len(compositeIds) > 0 {
+			condition = "(" + condition + " OR `slice_id` IN " + placeholderGroups(1, len(compositeIds)) + ")"
+		}
+		conditions = append(conditions, condition)
+		args = append(append(args, request.Category), compositeIds...)
+	}
+
+	if request.Blacklist {
+		if request.Metric != "" {
+			err = Blacklist.Add(BlacklistMetric, "", request.Metric)
+		} else {
+			err = Blacklist.Add(BlacklistSlice, request.Category, request.Name)
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Blacklist = true
+	}
+	//received and buffered rows would come back with the next flush
+	defer holdIngestion()()
+
+	for _, family := range tableFamilies {
+		if request.sliceOnly() && !family.slices {
+			continue
+		}
+		tables, err := purgeFamily(family, request, conditions, args)
+		report.Tables = append(report.Tables, tables...)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if !request.allDates() {
+		//the rows of the weekly and monthly periods overlapping the range were deleted whole
+		return report, rebuildPurgedRollups(request)
+	}
+	if request.Metric != "" && request.Category != "" {
+		return report, nil
+	}
+	if request.Metric != "" {
+		_, err = Db.Exec("DELETE FROM metrics WHERE id = ?", metricId)
+		MCache.Delete(request.Metric)
+		MetricRegistry.Remove(request.Metric)
+	} else {
+		_, err = Db.Exec("DELETE FROM slices WHERE id IN "+placeholderGroups(1, 1+len(compositeIds)), append([]interface{}{sliceId}, compositeIds...)...)
+		SlicesCache.Delete(sliceKey(request.Category, request.Name))
+		for _, composite := range composites {
+			SlicesCache.Delete(sliceKey(composite.category, composite.name))
+		}
+	}
+	report.Dictionary = err == nil
+	return report, err
+}
+
+type compositeSlice struct {
+	id       int
+	category string
+	name     string
+}
+
+// compositeSlices returns the composite slices built from the slice, or from any slice of the category
+// when name is empty, e.g. "country|platform" = "US|ios" for country US
+func compositeSlices(category string, name string) ([]compositeSlice, error) {
+	rows, err := Db.Query("SELECT id, category, name FROM slices WHERE category LIKE ?", "%"+escapeLike(combinationSeparator)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var composites []compositeSlice
+	for rows.Next() {
+		var composite compositeSlice
+		if err := rows.Scan(&composite.id, &composite.category, &composite.name); err != nil {
+			return nil, err
+		}
+		categories := strings.Split(composite.category, combinationSeparator)
+		names := strings.Split(composite.name, combinationSeparator)
+		for i, part := range categories {
+			if part == category && i < len(names) && (name == "" || names[i] == name) {
+				composites = append(composites, composite)
+				break
+			}
+		}
+	}
+	return composites, rows.Err()
+}
+
+// rebuildPurgedRollups rebuilds the rollups of the purged range from the purged per-minute and hourly rows.
+// An open range starts at the first hourly rollup and ends today
+func rebuildPurgedRollups(request purgeRequest) error {
+	from, to := request.From, request.To
+	if from.IsZero() {
+		var first sql.NullString
+		if err := Db.QueryRow("SELECT MIN(`date`) FROM (SELECT MIN(`date`) AS `date` FROM rollup_hourly_metrics " +
+			"UNION ALL SELECT MIN(`date`) FROM rollup_hourly_slices) AS firsts").Scan(&first); err != nil {
+			return err
+		}
+		if !first.Valid {
+			return nil
+		}
+		var err error
+		if from, err = time.ParseInLocation("2006-01-02", first.String[:10], time.Local); err != nil {
+			return err
+		}
+	}
+	if to.IsZero() {
+		now := time.Now()
+		to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	}
+	if to.Before(from) {
+		return nil
+	}
+	return rebuildRollups(from, to)
+}
+
+func purgeFamily(family tableFamily, request purgeRequest, conditions []string, args []interface{}) ([]purgedTable, error) {
+	var purged []purgedTable
+	var tables []string
+	if family.daily() {
+		daily, err := family.dailyTables()
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range daily {
+			if request.inRange(table.date) {
+				tables = append(tables, table.name)
+			}
+		}
+	} else {
+		tables = []string{family.table}
+		conditions = append([]string{}, conditions...)
+		args = append([]interface{}{}, args...)
+		if !request.From.IsZero() {
+			conditions = append(conditions, "`date` >= ?")
+			args = append(args, request.From.Format("2006-01-02"))
+		}
+		if !request.To.IsZero() {
+			conditions = append(conditions, "`date` <= ?")
+			args = append(args, request.To.Format("2006-01-02"))
+		}
+	}
+	for _, tableName := range tables {
+		result, err := Db.Exec("DELETE FROM `"+tableName+"` WHERE "+strings.Join(conditions, " AND "), args...)
+		if err != nil {
+			return purged, err
+		}
+		rows, _ := result.RowsAffected()
+		if rows > 0 {
+			slog.Info("Purged", "table", tableName, "rows", rows)
+			purged = append(purged, purgedTable{Table: tableName, Rows: rows})
+		}
+	}
+	return purged, nil
+}
+
+func parsePurgeDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// purgeHandler serves DELETE /admin/purge?metric=&category=&name=&from=2017-07-01&to=2017-07-14&blacklist=1
+func purgeHandler(c *gin.Context) {
+	request := purgeRequest{
+		Metric:    c.Query("metric"),
+		Category:  c.Query("category"),
+		Name:      c.Query("name"),
+		Blacklist: c.Query("blacklist") == "1",
+	}
+	var err error
+	if request.From, err = parsePurgeDate(c.Query("from")); err == nil {
+		request.To, err = parsePurgeDate(c.Query("to"))
+	}
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	report, err := purge(request)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// purgeServerAddress returns the address of the server of the config, on this host
+func purgeServerAddress(config *Config) string {
+	scheme, host := "http", config.Gin.Host
+	if config.Gin.TlsEnabled {
+		scheme = "https"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(config.Gin.Port))
+}
+
+// purgeOnServer runs the purge through DELETE /admin/purge of the server at address, so the running
+// server drops the purged ids from its caches, holds ingestion and applies the blacklist
+func purgeOnServer(address string, request purgeRequest) (purgeReport, error) {
+	report := purgeReport{}
+	query := url.Values{}
+	for name, value := range map[string]string{"metric": request.Metric, "category": request.Category, "name": request.Name} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if !request.From.IsZero() {
+		query.Set("from", request.From.Format("2006-01-02"))
+	}
+	if !request.To.IsZero() {
+		query.Set("to", request.To.Format("2006-01-02"))
+	}
+	if request.Blacklist {
+		query.Set("blacklist", "1")
+	}
+	httpRequest, err := http.NewRequest(http.MethodDelete, strings.TrimRight(address, "/")+"/admin/purge?"+query.Encode(), nil)
+	if err != nil {
+		return report, err
+	}
+	conf := Conf()
+	httpRequest.SetBasicAuth(conf.Gin.User, conf.Gin.Password)
+	response, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		return report, errors.New(err.Error() + ", use -local when no server runs")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		return report, errors.New(response.Status + ": " + failure.Error)
+	}
+	err = json.NewDecoder(response.Body).Decode(&report)
+	return report, err
+}
+
+// runPurgeCommand is `realmetric purge -metric name [-category c] [-name n] [-from date] [-to date] [-blacklist]
+// [-server address | -local]`. The purge runs on the server, whose caches and buffers hold the ids; -local runs
+// it in this process, only safe while no server runs
+func runPurgeCommand(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	request := purgeRequest{}
+	flags.StringVar(&request.Metric, "metric", "", "metric name")
+	flags.StringVar(&request.Category, "category", "", "slice category")
+	flags.StringVar(&request.Name, "name", "", "slice name")
+	from := flags.String("from", "", "first date to purge, YYYY-MM-DD")
+	to := flags.String("to", "", "last date to purge, YYYY-MM-DD")
+	flags.BoolVar(&request.Blacklist, "blacklist", false, "drop future events of the metric or slice")
+	server := flags.String("server", purgeServerAddress(Conf()), "address of the running server")
+	local := flags.Bool("local", false, "purge in this process, when no server runs")
+	flags.Parse(args)
+
+	var err error
+	if request.From, err = parsePurgeDate(*from); err != nil {
+		return err
+	}
+	if request.To, err = parsePurgeDate(*to); err != nil {
+		return err
+	}
+	var report purgeReport
+	if *local {
+		report, err = purge(request)
+	} else if err = request.validate(); err == nil {
+		report, err = purgeOnServer(*server, request)
+	}
+	for _, table := range report.Tables {
+		fmt.Println(table.Table + ": " + strconv.FormatInt(table.Rows, 10) + " rows")
+	}
+	return err
+}
@@ -3,45 +3,64 @@ package main
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"database/sql"
 	"encoding/json"
-	"github.com/gin-contrib/cors"
+	"flag"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
-	"hash/crc32"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	time2 "time"
 )
 
-var MCache metricsCache
-var SlicesCache slicesCache
-var DailyMetricsStore DailyMetricsStorage
-var DailyMetricsTotals DailyMetricsTotalsStorage
-var DailySlicesStore DailySlicesStorage
-var DailySlicesTotals DailySlicesTotalsStorage
+var MCache = metricsCache{idCache{resolve: resolveMetricIds}}
+var SlicesCache = slicesCache{idCache{resolve: resolveSliceIds}}
 var Db *sql.DB
-var Conf *Config
+
+//config in effect, replaced whole by a reload. Operations load it once with Conf() so they never mix two configs
+var currentConf atomic.Pointer[Config]
+
+// Conf returns the config in effect
+func Conf() *Config {
+	return currentConf.Load()
+}
 
 type InsertData struct {
-	TableName string
-	Fields    []string
-	Values    []interface{}
+	TableName       string
+	Fields          []string
+	IncrementFields []string
+	Values          []interface{}
+	//rows per statement, 0 means 40000 placeholders
+	BatchRows int
 }
 
 func (portions *InsertData) AppendValues(args ...interface{}) {
 	portions.Values = append(portions.Values, args...)
 }
 
-func (portions *InsertData) InsertIncrementBatch() {
+// maxPlaceholders is the most placeholders MySQL accepts in a prepared statement
+const maxPlaceholders = 65535
+
+// InsertIncrementBatch inserts the values by portions of BatchRows rows (40000 placeholders by default)
+// and returns the error of the last failed portion. Within tx it stops at the first failed portion,
+// the caller rolls back. Statements of full portions are prepared once and reused
+func (portions *InsertData) InsertIncrementBatch(ctx context.Context, tx *sql.Tx) error {
+	var lastErr error
 	portionCount := 40000
+	if portions.BatchRows > 0 {
+		portionCount = portions.BatchRows * len(portions.Fields)
+	}
 	portionCount = portionCount - (portionCount % len(portions.Fields))
 
 	currPortionNumber := 0
@@ -57,7 +76,6 @@ func (portions *InsertData) InsertIncrementBatch() {
 		}
 		Slice := portions.Values[startSlice:endSlice]
 		groupRepeatCount := len(Slice) / len(portions.Fields)
-		log.Println("endSlice: " + strconv.Itoa(endSlice) + " startSlice: " + strconv.Itoa(startSlice) + " portionLenFields: " + strconv.Itoa(len(portions.Fields)) + " SlicesLen:" + strconv.Itoa(len(Slice)))
 		fieldsStr := strings.Join(portions.Fields, ",")
 		SqlStr := "INSERT INTO " + portions.TableName + " (" + fieldsStr + ") VALUES "
 
@@ -65,146 +83,161 @@ func (portions *InsertData) InsertIncrementBatch() {
 		questionGroup = questionGroup[0 : len(questionGroup)-1]
 		SqlStr += strings.Repeat("("+questionGroup+"),", groupRepeatCount)
 		SqlStr = SqlStr[0 : len(SqlStr)-1]
-		SqlStr += " ON DUPLICATE KEY UPDATE `value` = `value` + VALUES(`value`)"
+		SqlStr += " ON DUPLICATE KEY UPDATE " + portions.incrementClause()
 
-		stmt, err := Db.Prepare(SqlStr)
+		err := Statements.Exec(ctx, tx, SqlStr, len(Slice) == portionCount, Slice)
 		if err != nil {
-			log.Print("Table: " + portions.TableName + " ")
-			log.Panic(err)
-		}
-		_, err = stmt.Exec(Slice...)
-		stmt.Close()
-		if err != nil {
-			log.Print("Table: " + portions.TableName + " ")
-			log.Println(err)
-			bytesJ, _ := json.Marshal(Slice)
-			log.Println(string(bytesJ))
+			insertErrors.Inc()
+			lastErr = err
+			slog.Error("Insert failed", "table", portions.TableName, "rows", groupRepeatCount,
+				"batch", currPortionNumber+1, "batches", countOfPortions, "error", err)
+			//the first row of the batch, for debugging
+			slog.Debug("Failed batch", "table", portions.TableName, "fields", portions.Fields, "row", Slice[:len(portions.Fields)])
+			if tx != nil {
+				return err
+			}
 		} else {
-			log.Println("Inserted")
+			slog.Debug("Inserted", "table", portions.TableName, "rows", groupRepeatCount,
+				"batch", currPortionNumber+1, "batches", countOfPortions)
 		}
 
 		currPortionNumber++
 	}
+	return lastErr
 }
 
-type metricsCache struct {
-	mu    sync.Mutex
-	cache map[string]int
-}
-
-type slicesCache struct {
-	mu    sync.Mutex
-	cache map[string]map[string]int
-	db    *sql.DB
+func (portions *InsertData) incrementClause() string {
+	incrementFields := portions.IncrementFields
+	if len(incrementFields) == 0 {
+		incrementFields = []string{"value"}
+	}
+	clauses := make([]string, 0, len(incrementFields))
+	for _, field := range incrementFields {
+		clauses = append(clauses, "`"+field+"` = `"+field+"` + VALUES(`"+field+"`)")
+	}
+	return strings.Join(clauses, ", ")
 }
 
 type Event struct {
-	Metric string
-	Slices map[string]string `json:"slices,omitempty"`
-	Time   int64
-	Value  int
-	Minute int
+	//optional, events with an already seen Id are dropped
+	Id         string `json:"id,omitempty"`
+	Metric     string
+	Slices     map[string]string `json:"slices,omitempty"`
+	Time       int64
+	Value      json.Number
+	Minute     int
+	Day        int32   `json:"-"`
+	IntValue   int64   `json:"-"`
+	FloatValue float64 `json:"-"`
 }
 
-func (sc *slicesCache) GetSliceIdByCategoryAndName(category string, name string) (int, error) {
-	sc.mu.Lock()
-	sliceId, ok := sc.cache[category][name]
-	if ok {
-		sc.mu.Unlock()
-		return sliceId, nil
-	}
+func (td *Event) FillMinute() error {
+	time := time2.Unix(td.Time, 0)
 
-	crc32category := crc32.ChecksumIEEE([]byte(category))
-	crc32name := crc32.ChecksumIEEE([]byte(name))
-	var id int
-	err := Db.QueryRow("SELECT id FROM slices WHERE category_crc_32=? AND name_crc_32=?", crc32category, crc32name).Scan(&id)
-	if err != nil {
-		//create id
-		stmt, es := Db.Prepare("INSERT IGNORE INTO slices (category, category_crc_32, name, name_crc_32) VALUES (?, ?, ?, ?)")
-		if es != nil {
-			log.Panic(es)
-		}
-		result, err := stmt.Exec(category, crc32category, name, crc32name)
-		if err != nil {
-			log.Panic(err)
-		}
-		insertId, _ := result.LastInsertId()
-		id = int(insertId)
-	}
-	sliceId = id
-	if _, ok = sc.cache[category]; !ok {
-		sc.cache[category] = make(map[string]int)
-	}
-	sc.cache[category][name] = sliceId
-	sc.mu.Unlock()
-	return sliceId, nil
+	td.Minute = time.Hour()*60 + time.Minute()
+	year, month, day := time.Date()
+	td.Day = int32(year*10000 + int(month)*100 + day)
+	return nil
 }
 
-func (mc *metricsCache) GetMetricIdByName(metricName string) (int, error) {
-	mc.mu.Lock()
-	metricId, ok := mc.cache[metricName]
-	if ok {
-		mc.mu.Unlock()
-		return metricId, nil
-	}
-	crc32name := crc32.ChecksumIEEE([]byte(metricName))
-	var id int
-
-	err := Db.QueryRow("SELECT id from metrics where name_crc_32=?", crc32name).Scan(&id)
+// DateKey is the date suffix of the daily tables the event belongs to
+func (td *Event) DateKey() string {
+	return time2.Unix(td.Time, 0).Format("2006_01_02")
+}
 
-	if err != nil {
-		//create id
-		stmt, es := Db.Prepare("INSERT IGNORE INTO metrics (name, name_crc_32) VALUES (?, ?)")
-		if es != nil {
-			log.Panic(es)
-		}
-		result, err := stmt.Exec(metricName, crc32name)
+// FillValue parses the raw Value according to the value mode of the metric:
+// float metrics go to FloatValue, everything else must be a signed 64-bit integer
+func (td *Event) FillValue(floatMode bool) error {
+	td.IntValue = 0
+	td.FloatValue = 0
+	if td.Value == "" {
+		return nil
+	}
+	if floatMode {
+		value, err := td.Value.Float64()
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		insertId, _ := result.LastInsertId()
-		id = int(insertId)
+		td.FloatValue = value
+		return nil
 	}
-
-	metricId = id
-	mc.cache[metricName] = metricId
-	mc.mu.Unlock()
-	return metricId, nil
+	value, err := td.Value.Int64()
+	if err != nil {
+		return err
+	}
+	td.IntValue = value
+	return nil
 }
 
-func (td *Event) FillMinute() error {
-	time := time2.Unix(td.Time, 0)
+func trackHandler(c *gin.Context) {
+	handleTracks(c, false)
+}
 
-	td.Minute = time.Hour()*60 + time.Minute()
-	return nil
+// backfillHandler imports historical events, bypassing the acceptance window
+func backfillHandler(c *gin.Context) {
+	handleTracks(c, true)
 }
 
-func trackHandler(c *gin.Context) {
+func handleTracks(c *gin.Context, backfill bool) {
+	conf := Conf()
 	startTime := time2.Now()
-	body, err := ioutil.ReadAll(c.Request.Body)
+	if Ingestion.Full() {
+		rejectBatch(c, errQueueFull)
+		return
+	}
+	maxBodyBytes := conf.Ingestion.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMaxBodyBytes
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyBytes))
 
 	if err != nil {
-		log.Fatal(err)
+		logSampled(slog.LevelWarn, "Cannot read body", "bytes", len(body), "error", err)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"createdEvents": 0,
+			"_timing":       time2.Since(startTime).Nanoseconds(),
+		})
 		return
 	}
 
 	zReader, err := zlib.NewReader(bytes.NewReader(body))
 	if err != nil {
-		log.Fatal(err)
+		logSampled(slog.LevelWarn, "Cannot decompress body", "bytes", len(body), "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"createdEvents": 0,
+			"_timing":       time2.Since(startTime).Nanoseconds(),
+		})
 		return
 	}
 	defer zReader.Close()
 
-	jsonBytes, err := ioutil.ReadAll(zReader)
+	maxDecompressed := conf.Ingestion.MaxDecompressedBytes
+	if maxDecompressed <= 0 {
+		maxDecompressed = defaultMaxDecompressed
+	}
+	//one byte over the limit tells a body of exactly the limit from a larger one
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(zReader, maxDecompressed+1))
 	if err != nil {
-		log.Fatal(err)
+		logSampled(slog.LevelWarn, "Cannot decompress body", "bytes", len(body), "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"createdEvents": 0,
+			"_timing":       time2.Since(startTime).Nanoseconds(),
+		})
+		return
+	}
+	if int64(len(jsonBytes)) > maxDecompressed {
+		logSampled(slog.LevelWarn, "Decompressed body too large", "bytes", len(body), "maxDecompressedBytes", maxDecompressed)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"createdEvents": 0,
+			"_timing":       time2.Since(startTime).Nanoseconds(),
+		})
 		return
 	}
 	var tracks []Event
 	//var jsonData []map[string]interface{}
 
 	if err := json.Unmarshal(jsonBytes, &tracks); err != nil {
-		log.Println(err.Error() + "Json: " + string(jsonBytes))
+		logSampled(slog.LevelWarn, "Cannot decode events", "bytes", len(jsonBytes), "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"createdEvents": 0,
 			"_timing":       time2.Since(startTime).Nanoseconds(),
@@ -212,42 +245,75 @@ func trackHandler(c *gin.Context) {
 		return
 	}
 
-	go aggregateEvents(tracks)
+	eventsReceived.Add(float64(len(tracks)))
+	reserved := len(tracks)
+	if err := Ingestion.Reserve(reserved); err != nil {
+		rejectBatch(c, err)
+		return
+	}
+	account := c.GetString(gin.AuthUserKey)
+	if key := c.GetHeader(idempotencyKeyHeader); key != "" && !Dedup.Claim(account+":batch:"+key) {
+		//a retry of an accepted batch
+		Ingestion.Release(int64(reserved))
+		eventsRejected.WithLabelValues(RejectDuplicate).Add(float64(len(tracks)))
+		c.JSON(http.StatusAccepted, gin.H{
+			"createdEvents": 0,
+			"duplicate":     true,
+			"_timing":       time2.Since(startTime).Nanoseconds(),
+		})
+		return
+	}
+	tracks, duplicates := dropDuplicates(tracks, account)
+	eventsRejected.WithLabelValues(RejectDuplicate).Add(float64(duplicates))
+
+	//backfills import historical times, only events without a time get the receive time
+	policy := TimestampPolicy{Mode: TimestampClient}
+	if !backfill {
+		policy = timestampPolicy(c)
+	}
+	stampEvents(tracks, policy, startTime)
+	Ingestion.Submit(tracks, backfill, reserved)
+	trackDuration.Observe(time2.Since(startTime).Seconds())
 
 	c.JSON(http.StatusAccepted, gin.H{
-		"createdEvents": 42,
-		"_timing":       time2.Since(startTime).Nanoseconds(),
+		"createdEvents":   42,
+		"duplicateEvents": duplicates,
+		"_timing":         time2.Since(startTime).Nanoseconds(),
 	})
 
 }
 
-func init() {
-	Conf = &Config{}
-	err := Conf.Init()
-	if err != nil {
-		log.Fatal(err)
-		return
-	}
-
-	dsn := Conf.Db.User + ":" + Conf.Db.Password + "@tcp(" + Conf.Db.Host + ":" + strconv.Itoa(Conf.Db.Port) + ")/" + Conf.Db.Database + "?charset=" + Conf.Db.Charset + "&timeout=" + strconv.Itoa(Conf.Db.Timeout) + "s&sql_mode=TRADITIONAL&autocommit=true"
+// setup connects to the database and creates the tables
+func setup() {
+	conf := Conf()
+	dsn := conf.Db.User + ":" + conf.Db.Password + "@tcp(" + conf.Db.Host + ":" + strconv.Itoa(conf.Db.Port) + ")/" + conf.Db.Database + "?charset=" + conf.Db.Charset + "&timeout=" + strconv.Itoa(conf.Db.Timeout) + "s&sql_mode=TRADITIONAL&autocommit=true"
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		log.Fatal(err)
-		return
+		fatal("Cannot open database", "error", err)
 	}
 	Db = db
 
 	createTables()
+	createRollupTables()
+}
+
+// warmup checks the tables were migrated and warms up the caches
+func warmup() {
+	requireMigrations()
+	checkIdSpace()
 	warmupMetricsCache()
 	warmupSlicesCache()
+	warmupMetricRegistry()
+	warmupBlacklist()
 }
 
 func createTables(){
 	//monthly_metrics
 	sqlStr := "CREATE TABLE IF NOT EXISTS `monthly_metrics` ("+
 	"`id` int(10) unsigned NOT NULL AUTO_INCREMENT,"+
-		"`metric_id` smallint(5) unsigned NOT NULL,"+
-		"`value` int(11) unsigned NOT NULL,"+
+		"`metric_id` int(10) unsigned NOT NULL,"+
+		"`value` bigint(20) NOT NULL,"+
+		"`value_float` double NOT NULL DEFAULT '0',"+
 		"`date` date NOT NULL,"+
 		"PRIMARY KEY (`id`),"+
 		"UNIQUE KEY `monthly_metrics_metric_id_date_unique` (`metric_id`,`date`),"+
@@ -255,19 +321,20 @@ func createTables(){
 	") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
 	stmt, err := Db.Prepare(sqlStr)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "monthly_metrics", "error", err)
 	}
 	_, err = stmt.Exec()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "monthly_metrics", "error", err)
 	}
 
 	//monthly_slices
 	sqlStr = "CREATE TABLE IF NOT EXISTS `monthly_slices` ("+
 	"`id` int(10) unsigned NOT NULL AUTO_INCREMENT,"+
-		"`metric_id` smallint(5) unsigned NOT NULL,"+
-		"`slice_id` smallint(5) unsigned NOT NULL,"+
-		"`value` int(11) unsigned NOT NULL,"+
+		"`metric_id` int(10) unsigned NOT NULL,"+
+		"`slice_id` int(10) unsigned NOT NULL,"+
+		"`value` bigint(20) NOT NULL,"+
+		"`value_float` double NOT NULL DEFAULT '0',"+
 		"`date` date NOT NULL,"+
 		"PRIMARY KEY (`id`),"+
 		"UNIQUE KEY `monthly_slices_metric_id_slice_id_date_unique` (`metric_id`,`slice_id`,`date`),"+
@@ -276,62 +343,86 @@ func createTables(){
 	") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
 	stmt, err = Db.Prepare(sqlStr)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "monthly_slices", "error", err)
 	}
 	_, err = stmt.Exec()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "monthly_slices", "error", err)
 	}
 
 	//metrics
 	sqlStr = "CREATE TABLE IF NOT EXISTS `metrics` ("+
 	"`id` int(10) unsigned NOT NULL AUTO_INCREMENT,"+
-		"`name` varchar(255) COLLATE utf8_unicode_ci NOT NULL,"+
+		"`name` varchar(255) COLLATE utf8_bin NOT NULL,"+
 		"`name_crc_32` int(10) unsigned NOT NULL,"+
+		"`description` varchar(1024) COLLATE utf8_unicode_ci NOT NULL DEFAULT '',"+
+		"`unit` varchar(64) COLLATE utf8_unicode_ci NOT NULL DEFAULT '',"+
+		"`value_type` varchar(16) COLLATE utf8_unicode_ci NOT NULL DEFAULT '',"+
+		"`owner_team` varchar(255) COLLATE utf8_unicode_ci NOT NULL DEFAULT '',"+
+		"`tags` varchar(1024) COLLATE utf8_unicode_ci NOT NULL DEFAULT '',"+
+		"`registered` tinyint(1) NOT NULL DEFAULT '0',"+
+		"`auto_create` tinyint(1) NOT NULL DEFAULT '1',"+
 		"PRIMARY KEY (`id`),"+
 		"UNIQUE KEY `metrics_name_unique` (`name`),"+
 		"KEY `metrics_name_crc_32_index` (`name_crc_32`)"+
 	") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
 	stmt, err = Db.Prepare(sqlStr)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "metrics", "error", err)
 	}
 	_, err = stmt.Exec()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "metrics", "error", err)
 	}
 
 	//slices
 	sqlStr = "CREATE TABLE IF NOT EXISTS `slices` ("+
 	"`id` int(10) unsigned NOT NULL AUTO_INCREMENT,"+
-		"`category` varchar(255) COLLATE utf8_unicode_ci NOT NULL,"+
+		"`category` varchar(255) COLLATE utf8_bin NOT NULL,"+
 		"`category_crc_32` int(10) unsigned NOT NULL,"+
-		"`name` varchar(255) COLLATE utf8_unicode_ci NOT NULL,"+
+		"`name` varchar(255) COLLATE utf8_bin NOT NULL,"+
 		"`name_crc_32` int(10) unsigned NOT NULL,"+
 		"PRIMARY KEY (`id`),"+
+		"UNIQUE KEY `slices_category_name_unique` (`category`,`name`),"+
 		"KEY `slices_category_crc_32_name_crc_32_index` (`category_crc_32`,`name_crc_32`)"+
 	") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
 	stmt, err = Db.Prepare(sqlStr)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "slices", "error", err)
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		fatal("Cannot create table", "table", "slices", "error", err)
+	}
+
+	//blacklist
+	sqlStr = "CREATE TABLE IF NOT EXISTS `blacklist` (" +
+		"`id` int(10) unsigned NOT NULL AUTO_INCREMENT," +
+		"`kind` varchar(16) COLLATE utf8_unicode_ci NOT NULL," +
+		"`category` varchar(255) COLLATE utf8_unicode_ci NOT NULL DEFAULT ''," +
+		"`name` varchar(255) COLLATE utf8_unicode_ci NOT NULL," +
+		"PRIMARY KEY (`id`)," +
+		"UNIQUE KEY `blacklist_kind_category_name_unique` (`kind`,`category`,`name`)" +
+		") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
+	stmt, err = Db.Prepare(sqlStr)
+	if err != nil {
+		fatal("Cannot create table", "table", "blacklist", "error", err)
 	}
 	_, err = stmt.Exec()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot create table", "table", "blacklist", "error", err)
 	}
 }
 
 func warmupMetricsCache() {
 	rows, err := Db.Query("SELECT id, name FROM metrics")
 	if err != nil {
-		log.Fatal(err)
-		return
+		fatal("Cannot warm up metrics cache", "table", "metrics", "error", err)
 	}
 
-	r, err := regexp.Compile(Conf.MetricNameValidationRegexp)
+	r, err := regexp.Compile(Conf().MetricNameValidationRegexp)
 	if err != nil {
-		log.Panic(err)
-		os.Exit(1)
+		fatal("Invalid MetricNameValidationRegexp", "error", err)
 	}
 	cacheMetrics := make(map[string]int)
 	for rows.Next() {
@@ -339,120 +430,193 @@ func warmupMetricsCache() {
 		var name string
 		err = rows.Scan(&id, &name)
 		if err != nil {
-			log.Println("Skip unresolved metric row")
+			slog.Warn("Skip unresolved row", "table", "metrics", "error", err)
 			continue
 		}
 		if r.MatchString(name) {
-			log.Println("Skip metric by regexp: " + name)
+			logSampled(slog.LevelWarn, "Skip metric by regexp", "metric", name, "id", id)
 			continue
 		}
 		cacheMetrics[name] = id
 
 	}
-	MCache.mu.Lock()
-	MCache.cache = cacheMetrics
-	MCache.mu.Unlock()
+	MCache.Reset(cacheMetrics)
 }
 
 func warmupSlicesCache() {
 	rows, err := Db.Query("SELECT id, category, name FROM slices")
 	if err != nil {
-		log.Fatal(err)
-		return
+		fatal("Cannot warm up slices cache", "table", "slices", "error", err)
 	}
-	r, err := regexp.Compile(Conf.SliceNameValidationRegexp)
+	r, err := regexp.Compile(Conf().SliceNameValidationRegexp)
 	if err != nil {
-		log.Panic(err)
-		os.Exit(1)
+		fatal("Invalid SliceNameValidationRegexp", "error", err)
 	}
-	cacheSlices := make(map[string]map[string]int)
+	cacheSlices := make(map[string]int)
+	categoryNames := make(map[string]map[string]struct{})
 	for rows.Next() {
 		var id int
 		var name string
 		var category string
 		err = rows.Scan(&id, &category, &name)
 		if err != nil {
-			log.Println("Skip unresolved slice row")
+			slog.Warn("Skip unresolved row", "table", "slices", "error", err)
 			continue
 		}
-		if r.MatchString(name) {
-			log.Println("Skip slice by regexp: " + name)
+		if invalidSliceName(r, category, name) {
+			logSampled(slog.LevelWarn, "Skip slice by regexp", "category", category, "slice", name, "id", id)
 			continue
 		}
-		if _, ok := cacheSlices[category]; !ok {
-			cacheSlices[category] = make(map[string]int)
+		cacheSlices[sliceKey(category, name)] = id
+		if _, ok := categoryNames[category]; !ok {
+			categoryNames[category] = make(map[string]struct{})
 		}
-		cacheSlices[category][name] = id
+		categoryNames[category][name] = struct{}{}
 	}
-	SlicesCache.mu.Lock()
-	SlicesCache.cache = cacheSlices
-	SlicesCache.mu.Unlock()
+	SlicesCache.Reset(cacheSlices)
+	Cardinality.Warmup(categoryNames)
 
 }
 
+// main is `realmetric [-config path] [-print-config] [command args]`, commands being
+// migrate, purge and rollup. The config path may also come from REALMETRIC_CONFIG
 func main() {
-	//start flush daily_metrics ticker
-	ticker := time2.NewTicker(time2.Duration(Conf.FlushToDbInterval) * time2.Second)
-	go func() {
-		for range ticker.C {
-			DailyMetricsStore.FlushToDb()
-			DailySlicesStore.FlushToDb()
+	//json records until the config sets the format
+	setupLogging(LogConfig{})
+	if path := os.Getenv(envPrefix + "_CONFIG"); path != "" {
+		configPath = path
+	}
+	flag.StringVar(&configPath, "config", configPath, "config file")
+	printConfig := flag.Bool("print-config", false, "print the effective config, passwords redacted, and exit")
+	flag.Parse()
+
+	config := &Config{}
+	if err := config.Init(configPath); err != nil {
+		fatal("Invalid config", "config", configPath, "error", err)
+	}
+	currentConf.Store(config)
+	applyConfig()
+	if *printConfig {
+		effective, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+		fmt.Println(string(effective))
+		return
+	}
+	command, args := "", []string{}
+	if flag.NArg() > 0 {
+		command, args = flag.Arg(0), flag.Args()[1:]
+	}
+	setup()
+	if command == "migrate" {
+		if err := runMigrations(); err != nil {
+			fatal("Migration failed", "error", err)
 		}
-	}()
-	//start flush daily_metric_totals ticker
-	ticker2 := time2.NewTicker(time2.Duration(Conf.FlushTotalsInterval) * time2.Second)
-	go func() {
-		for range ticker2.C {
-			DailyMetricsTotals.FlushToDb()
-			DailySlicesTotals.FlushToDb()
+		return
+	}
+	warmup()
+	if command == "purge" {
+		if err := runPurgeCommand(args); err != nil {
+			fatal("Purge failed", "error", err)
 		}
-	}()
+		return
+	}
+	if command == "rollup" {
+		if err := runRollupCommand(args); err != nil {
+			fatal("Rollup failed", "error", err)
+		}
+		return
+	}
+	if command != "" {
+		fatal("Unknown command", "command", command)
+	}
+
+	FlushControl.StartTickers()
+
+	Schema.Start()
+	Dedup.Start()
+	Ingestion.Start()
+	Janitor.Start()
+	MetricRegistry.Start()
+	startRollups()
 
 	//setup gin
-	gin.SetMode(Conf.Gin.Mode)
+	gin.SetMode(config.Gin.Mode)
 	server := gin.Default()
-	//add cors
-	config := cors.DefaultConfig()
-	config.AllowCredentials = true
-	config.AllowAllOrigins = true
-	server.Use(cors.New(config))
-	authorized := server.Group("/", gin.BasicAuth(gin.Accounts{Conf.Gin.User: Conf.Gin.Password}))
-
+	//cors and basic auth follow config reloads
+	server.Use(corsHandler.Handle)
+	authorized := server.Group("/", authorizedAuth.Handle)
+	tracking := server.Group("/", trackingAuth.Handle)
+	backfill := server.Group("/", backfillAuth.Handle)
+	watchReloadSignal()
+
+	server.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	server.GET("/healthz", healthzHandler)
+	server.GET("/readyz", readyzHandler)
 	server.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
 		})
 	})
-	authorized.POST("/track", trackHandler)
-	if Conf.Gin.TlsEnabled {
-		server.RunTLS(Conf.Gin.Host+":"+strconv.Itoa(Conf.Gin.Port), Conf.Gin.TlsCertFilePath, Conf.Gin.TlsKeyFilePath)
+	tracking.POST("/track", trackHandler)
+	authorized.GET("/acceptance", acceptanceHandler)
+	authorized.GET("/cardinality", cardinalityHandler)
+	authorized.GET("/slices/query", sliceQueryHandler)
+	authorized.GET("/registry/metrics", registryListHandler)
+	authorized.GET("/registry/metrics/:name", registryGetHandler)
+	authorized.POST("/registry/metrics", registryCreateHandler)
+	authorized.PUT("/registry/metrics/:name", registryUpdateHandler)
+	authorized.DELETE("/registry/metrics/:name", registryDeleteHandler)
+
+	backfill.POST("/backfill", backfillHandler)
+
+	admin := authorized.Group("/admin")
+	admin.POST("/metrics/rename", renameMetricHandler)
+	admin.POST("/metrics/merge", mergeMetricHandler)
+	admin.POST("/slices/rename", renameSliceHandler)
+	admin.POST("/slices/merge", mergeSliceHandler)
+	admin.DELETE("/purge", purgeHandler)
+	admin.GET("/retention", retentionHandler)
+	admin.POST("/retention", retentionHandler)
+	admin.POST("/rollups/rebuild", rollupRebuildHandler)
+	admin.GET("/flush", flushStatusHandler)
+	admin.POST("/flush", flushHandler)
+	admin.POST("/flush/pause", pauseFlushHandler)
+	admin.POST("/flush/resume", resumeFlushHandler)
+	admin.GET("/buffers", buffersHandler)
+	admin.POST("/config/reload", reloadHandler)
+	if config.Gin.TlsEnabled {
+		server.RunTLS(config.Gin.Host+":"+strconv.Itoa(config.Gin.Port), config.Gin.TlsCertFilePath, config.Gin.TlsKeyFilePath)
 	} else {
-		server.Run(Conf.Gin.Host + ":" + strconv.Itoa(Conf.Gin.Port))
+		server.Run(config.Gin.Host + ":" + strconv.Itoa(config.Gin.Port))
 	}
 
 }
 
-func aggregateEvents(tracks []Event) int {
-	r, err := regexp.Compile(Conf.MetricNameValidationRegexp)
-	if err != nil {
-		log.Panic(err)
-	}
+// aggregateEvents adds the accepted events to the storages, in the accumulators of the worker
+func aggregateEvents(tracks []Event, backfill bool, worker int) int {
+	//one config for the whole batch, a reload applies to the next one
+	conf := Conf()
+	tracks = acceptEvents(tracks, metricNameValidation.Load().(*regexp.Regexp), !backfill)
+	foldSlices(conf, tracks)
+	prefetchIds(tracks)
 
 	counter := 0
 	for _, event := range tracks {
-		if r.MatchString(event.Metric) {
-			log.Println("Skip invalid metric: " + event.Metric)
+		event.FillMinute()
+		if err := event.FillValue(MetricRegistry.IsFloatMetric(event.Metric)); err != nil {
+			logSampled(slog.LevelWarn, "Skip invalid value", "metric", event.Metric, "value", event.Value.String(), "error", err)
+			eventsRejected.WithLabelValues(RejectInvalidValue).Inc()
 			continue
 		}
-		event.FillMinute()
 		metricId, err := MCache.GetMetricIdByName(event.Metric)
 		if err != nil {
-			log.Println("Cannot get metric id: " + event.Metric)
+			logSampled(slog.LevelError, "Cannot get metric id", "metric", event.Metric, "error", err)
+			eventsRejected.WithLabelValues(RejectNoMetricId).Inc()
 			continue
 		}
-		if DailyMetricsStore.Inc(metricId, event) && DailyMetricsTotals.Inc(metricId, event) {
-			counter++
-		}
+		DailyMetricsStore.Inc(worker, metricId, 0, event)
+		DailyMetricsTotals.Inc(worker, metricId, 0, event)
+		counter++
+		eventsAccepted.Inc()
 		//slices
 		if event.Slices == nil {
 			continue
@@ -461,13 +625,108 @@ func aggregateEvents(tracks []Event) int {
 		for category, name := range event.Slices {
 			sliceId, err := SlicesCache.GetSliceIdByCategoryAndName(category, name)
 			if err != nil {
-				log.Println("Cannot get metric id: " + event.Metric)
+				logSampled(slog.LevelError, "Cannot get slice id", "category", category, "slice", name, "error", err)
 				continue
 			}
-			DailySlicesStore.Inc(metricId, sliceId, event)
-			DailySlicesTotals.Inc(metricId, sliceId, event)
+			DailySlicesStore.Inc(worker, metricId, sliceId, event)
+			DailySlicesTotals.Inc(worker, metricId, sliceId, event)
 		}
 
 	}
 	return counter
 }
+
+// acceptEvents drops events with invalid metric names, events the metric registry rejects
+// and, with checkWindow, events outside the acceptance window
+func acceptEvents(tracks []Event, metricNameValidation *regexp.Regexp, checkWindow bool) []Event {
+	accepted := tracks[:0]
+	now := time2.Now()
+	for _, event := range tracks {
+		if checkWindow {
+			if reason := rejectTimestamp(event.Time, now); reason != "" {
+				TimestampRejections.add(reason)
+				eventsRejected.WithLabelValues(reason).Inc()
+				continue
+			}
+		}
+		if metricNameValidation.MatchString(event.Metric) {
+			logSampled(slog.LevelWarn, "Skip invalid metric", "metric", event.Metric)
+			eventsRejected.WithLabelValues(RejectInvalidMetric).Inc()
+			continue
+		}
+		if Blacklist.HasMetric(event.Metric) {
+			eventsRejected.WithLabelValues(RejectBlacklisted).Inc()
+			continue
+		}
+		if reason := MetricRegistry.Reject(event.Metric); reason != "" {
+			logSampled(slog.LevelWarn, "Skip metric rejected by registry", "metric", event.Metric, "reason", reason)
+			eventsRejected.WithLabelValues(RejectRegistry).Inc()
+			continue
+		}
+		accepted = append(accepted, event)
+	}
+	return accepted
+}
+
+// foldSlices adds the slice combinations of the events, drops invalid and blacklisted slices and slices of
+// categories over the cardinality limit, and replaces names of slices over the limits of their category
+// or of their metric with otherSliceName. It runs before ids are resolved, so no id is created for them
+func foldSlices(conf *Config, tracks []Event) {
+	for _, event := range tracks {
+		//composite slices are not built from blacklisted slices
+		for category, name := range event.Slices {
+			if Blacklist.HasSlice(category, name) {
+				delete(event.Slices, category)
+			}
+		}
+		expandCombinations(conf, event)
+		for category, name := range event.Slices {
+			if strings.Contains(category, sliceKeySeparator) || strings.Contains(name, sliceKeySeparator) {
+				logSampled(slog.LevelWarn, "Skip invalid slice", "metric", event.Metric, "category", category, "slice", name)
+				delete(event.Slices, category)
+				continue
+			}
+			if Blacklist.HasSlice(category, name) || !Cardinality.AllowCategory(conf, event.Metric, category) {
+				delete(event.Slices, category)
+				continue
+			}
+			event.Slices[category] = Cardinality.SliceName(conf, event.Metric, event.DateKey(), category, name)
+		}
+	}
+}
+
+// prefetchIds resolves all metric and slice ids of the batch at once,
+// so new names cost a few queries per batch instead of a few per event
+func prefetchIds(tracks []Event) {
+	var metricNames []string
+	var sliceKeys []string
+	for _, event := range tracks {
+		if _, ok := MCache.Get(event.Metric); ok {
+			metricCacheHits.Inc()
+		} else {
+			metricCacheMisses.Inc()
+			metricNames = append(metricNames, event.Metric)
+		}
+		for category, name := range event.Slices {
+			if strings.Contains(category, sliceKeySeparator) || strings.Contains(name, sliceKeySeparator) {
+				continue
+			}
+			if _, ok := SlicesCache.Get(sliceKey(category, name)); ok {
+				sliceCacheHits.Inc()
+			} else {
+				sliceCacheMisses.Inc()
+				sliceKeys = append(sliceKeys, sliceKey(category, name))
+			}
+		}
+	}
+	if len(metricNames) > 0 {
+		if _, err := MCache.Resolve(metricNames); err != nil {
+			logSampled(slog.LevelError, "Cannot prefetch metric ids", "table", "metrics", "metrics", len(metricNames), "error", err)
+		}
+	}
+	if len(sliceKeys) > 0 {
+		if _, err := SlicesCache.Resolve(sliceKeys); err != nil {
+			logSampled(slog.LevelError, "Cannot prefetch slice ids", "table", "slices", "slices", len(sliceKeys), "error", err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// restartOnly are the config paths applied at startup only, a reload changing one of them is rejected
+var restartOnly = []string{
+	"Db",
+	"Gin.Mode",
+	"Gin.Host",
+	"Gin.Port",
+	"Gin.TlsEnabled",
+	"Gin.TlsCertFilePath",
+	"Gin.TlsKeyFilePath",
+	"Ingestion.Workers",
+	"Ingestion.QueueSize",
+	"Flush.Concurrency",
+	"Dedup.Persist",
+	//read when their goroutines start
+	"Retention.CheckInterval",
+	"Rollup.Interval",
+	"Schema.PrecreateTablesAt",
+}
+
+var (
+	configPath = defaultConfigPath
+	reloadMu   sync.Mutex
+	//compiled Conf.MetricNameValidationRegexp
+	metricNameValidation atomic.Value
+	authorizedAuth       reloadableHandler
+	trackingAuth         reloadableHandler
+	backfillAuth         reloadableHandler
+	corsHandler          reloadableHandler
+)
+
+// reloadableHandler is a middleware that can be replaced while the server runs
+type reloadableHandler struct {
+	handler atomic.Value
+}
+
+func (reloadable *reloadableHandler) Set(handler gin.HandlerFunc) {
+	reloadable.handler.Store(handler)
+}
+
+func (reloadable *reloadableHandler) Handle(c *gin.Context) {
+	reloadable.handler.Load().(gin.HandlerFunc)(c)
+}
+
+func corsConfig(config *Config) cors.Config {
+	corsConf := cors.DefaultConfig()
+	corsConf.AllowCredentials = true
+	if len(config.Cors.AllowOrigins) == 0 {
+		corsConf.AllowAllOrigins = true
+	} else {
+		corsConf.AllowOrigins = config.Cors.AllowOrigins
+	}
+	if len(config.Cors.AllowHeaders) > 0 {
+		corsConf.AddAllowHeaders(config.Cors.AllowHeaders...)
+	}
+	return corsConf
+}
+
+// applyConfig puts the settings of Conf that can change while running into effect
+func applyConfig() {
+	conf := Conf()
+	metricNameValidation.Store(regexp.MustCompile(conf.MetricNameValidationRegexp))
+	setupLogging(conf.Log)
+	FlushControl.ResetIntervals()
+
+	authorizedAuth.Set(gin.BasicAuth(gin.Accounts{conf.Gin.User: conf.Gin.Password}))
+	//Gin.Accounts may only track
+	accounts := gin.Accounts{conf.Gin.User: conf.Gin.Password}
+	for user, password := range conf.Gin.Accounts {
+		accounts[user] = password
+	}
+	trackingAuth.Set(gin.BasicAuth(accounts))
+	if conf.Acceptance.BackfillUser != "" {
+		backfillAuth.Set(gin.BasicAuth(gin.Accounts{conf.Acceptance.BackfillUser: conf.Acceptance.BackfillPassword}))
+	} else {
+		backfillAuth.Set(func(c *gin.Context) {
+			c.AbortWithStatus(http.StatusNotFound)
+		})
+	}
+	corsHandler.Set(cors.New(corsConfig(conf)))
+}
+
+// configChanges returns the paths of the fields differing between two configs, down to restartOnly paths
+func configChanges(current reflect.Value, next reflect.Value, prefix string) []string {
+	var changes []string
+	for i := 0; i < current.NumField(); i++ {
+		path := current.Type().Field(i).Name
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if current.Field(i).Kind() == reflect.Struct && !isRestartOnly(path) {
+			changes = append(changes, configChanges(current.Field(i), next.Field(i), path)...)
+		} else if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			changes = append(changes, path)
+		}
+	}
+	return changes
+}
+
+func isRestartOnly(path string) bool {
+	for _, restartPath := range restartOnly {
+		if path == restartPath {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadConfig reads the config file again and applies it, unless it is invalid or changes
+// settings that need a restart. It returns the changed paths
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	next := &Config{}
+	if err := next.Init(configPath); err != nil {
+		return nil, err
+	}
+	changes := configChanges(reflect.ValueOf(Conf()).Elem(), reflect.ValueOf(next).Elem(), "")
+	var restart []string
+	for _, path := range changes {
+		if isRestartOnly(path) {
+			restart = append(restart, path)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, &restartRequiredError{paths: restart}
+	}
+	currentConf.Store(next)
+	applyConfig()
+	slog.Info("Config reloaded", "config", configPath, "changed", changes)
+	return changes, nil
+}
+
+type restartRequiredError struct {
+	paths []string
+}
+
+func (err *restartRequiredError) Error() string {
+	return "restart required to change " + strings.Join(err.paths, ", ") + ", config not reloaded"
+}
+
+// watchReloadSignal reloads the config on SIGHUP
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if _, err := reloadConfig(); err != nil {
+				slog.Error("Config reload failed", "config", configPath, "error", err)
+			}
+		}
+	}()
+}
+
+// reloadHandler serves POST /admin/config/reload
+func reloadHandler(c *gin.Context) {
+	changes, err := reloadConfig()
+	if err != nil {
+		status := http.StatusBadRequest
+		if _, ok := err.(*restartRequiredError); ok {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"reloaded": false, "error": err.Error()})
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"reloaded": true, "changed": changes})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `{
+  "Db": {"Host": "localhost", "Port": 3306, "User": "realmetric", "Password": "secret", "Database": "realmetric"},
+  "Gin": {"Port": %PORT%, "User": "admin", "Password": "admin"},
+  "FlushToDbInterval": %FLUSH%,
+  "FlushTotalsInterval": 120,
+  "MetricNameValidationRegexp": "[^a-z0-9._-]"
+}`
+
+func writeTestConfig(t *testing.T, port string, flush string) string {
+	t.Helper()
+	content := strings.NewReplacer("%PORT%", port, "%FLUSH%", flush).Replace(testConfig)
+	path := filepath.Join(t.TempDir(), "config.json5")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigChanges(t *testing.T) {
+	current := Config{FlushToDbInterval: 20}
+	current.Gin.Port = 8080
+	current.Retention.Days = map[string]int{"daily_metrics": 30}
+	tests := []struct {
+		name   string
+		change func(config *Config)
+		want   []string
+	}{
+		{"unchanged", func(config *Config) {}, nil},
+		{"allowed", func(config *Config) { config.FlushToDbInterval = 30 }, []string{"FlushToDbInterval"}},
+		{"restart only", func(config *Config) { config.Gin.Port = 9090 }, []string{"Gin.Port"}},
+		{"whole restart only struct", func(config *Config) { config.Db.Host = "other" }, []string{"Db"}},
+		{"map", func(config *Config) { config.Retention.Days = map[string]int{"daily_metrics": 7} }, []string{"Retention.Days"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := current
+			next.Retention.Days = map[string]int{"daily_metrics": 30}
+			test.change(&next)
+			got := configChanges(reflect.ValueOf(current), reflect.ValueOf(next), "")
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("configChanges() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	previousPath := configPath
+	defer func() { configPath = previousPath }()
+	configPath = writeTestConfig(t, "8080", "20")
+	initial := &Config{}
+	if err := initial.Init(configPath); err != nil {
+		t.Fatal(err)
+	}
+	currentConf.Store(initial)
+	applyConfig()
+
+	configPath = writeTestConfig(t, "8080", "30")
+	changes, err := reloadConfig()
+	if err != nil {
+		t.Fatalf("allowed change: %v", err)
+	}
+	if !reflect.DeepEqual(changes, []string{"FlushToDbInterval"}) {
+		t.Errorf("allowed change: changes = %v, want [FlushToDbInterval]", changes)
+	}
+	if Conf().FlushToDbInterval != 30 {
+		t.Errorf("allowed change: FlushToDbInterval = %d, want 30", Conf().FlushToDbInterval)
+	}
+
+	configPath = writeTestConfig(t, "9090", "30")
+	_, err = reloadConfig()
+	restartErr, ok := err.(*restartRequiredError)
+	if !ok {
+		t.Fatalf("restart only change: error = %v, want a restartRequiredError", err)
+	}
+	if !reflect.DeepEqual(restartErr.paths, []string{"Gin.Port"}) {
+		t.Errorf("restart only change: paths = %v, want [Gin.Port]", restartErr.paths)
+	}
+	if Conf().Gin.Port != 8080 {
+		t.Errorf("restart only change applied, Gin.Port = %d", Conf().Gin.Port)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"hash/crc32"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// adminMu serializes the admin operations rewriting aggregate tables
+var adminMu sync.Mutex
+
+var errNotFound = errors.New("not found")
+
+type mergedTable struct {
+	Table      string  `json:"table"`
+	Rows       int64   `json:"rows"`
+	Value      int64   `json:"value"`
+	ValueFloat float64 `json:"valueFloat"`
+}
+
+// mergeReport lists the tables merged, so far when the merge failed. A failed merge is resumed by
+// running it again: merged tables have no rows of the merged id left, the others are merged then
+type mergeReport struct {
+	DryRun bool          `json:"dryRun"`
+	FromId int           `json:"fromId"`
+	IntoId int           `json:"intoId"`
+	Tables []mergedTable `json:"tables"`
+	//merges of the composite slices built from a merged or renamed slice
+	Composites []mergeReport `json:"composites,omitempty"`
+}
+
+type metricRenameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type metricMergeRequest struct {
+	From   string `json:"from"`
+	Into   string `json:"into"`
+	DryRun bool   `json:"dryRun"`
+}
+
+type sliceRenameRequest struct {
+	Category    string `json:"category"`
+	Name        string `json:"name"`
+	NewCategory string `json:"newCategory"`
+	NewName     string `json:"newName"`
+}
+
+type sliceMergeRequest struct {
+	Category     string `json:"category"`
+	Name         string `json:"name"`
+	IntoCategory string `json:"intoCategory"`
+	IntoName     string `json:"intoName"`
+	DryRun       bool   `json:"dryRun"`
+}
+
+// mergedIds maps the ids of merged metrics and slices to the ids they were merged into,
+// until restart. Flushes write buffered rows of a merged id under the id it was merged into
+type mergedIds struct {
+	mu      sync.RWMutex
+	metrics map[uint32]uint32
+	slices  map[uint32]uint32
+}
+
+var MergedIds mergedIds
+
+func (merged *mergedIds) set(ids *map[uint32]uint32, fromId int, intoId int) {
+	merged.mu.Lock()
+	if *ids == nil {
+		*ids = make(map[uint32]uint32)
+	}
+	(*ids)[uint32(fromId)] = uint32(intoId)
+	merged.mu.Unlock()
+}
+
+// remap returns the key with the ids it was merged into, following merges of merged ids
+func (merged *mergedIds) remap(key aggregateKey) aggregateKey {
+	merged.mu.RLock()
+	defer merged.mu.RUnlock()
+	for id, ok := merged.metrics[key.metricId]; ok; id, ok = merged.metrics[key.metricId] {
+		key.metricId = id
+	}
+	for id, ok := merged.slices[key.sliceId]; ok && key.sliceId != 0; id, ok = merged.slices[key.sliceId] {
+		key.sliceId = id
+	}
+	return key
+}
+
+// flushAllStorages writes everything buffered in memory, so admin operations see all the data in the tables
+func flushAllStorages() {
+	DailyMetricsStore.FlushToDb()
+	DailySlicesStore.FlushToDb()
+	DailyMetricsTotals.FlushToDb()
+	DailySlicesTotals.FlushToDb()
+}
+
+// holdIngestion pauses the flush tickers, waits until the received events are aggregated and writes
+// them, so an admin operation deleting rows is not undone by events received before it. New batches
+// are answered 503 until the returned func resumes ingestion and the tickers
+func holdIngestion() func() {
+	wasPaused := FlushControl.Paused()
+	FlushControl.setPaused(true)
+	Ingestion.Drain()
+	flushAllStorages()
+	return func() {
+		Ingestion.Resume()
+		if !wasPaused {
+			FlushControl.setPaused(false)
+		}
+	}
+}
+
+func storedMetricId(metricName string) (int, error) {
+	var id int
+	err := Db.QueryRow("SELECT id FROM metrics WHERE name = ?", metricName).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	return id, err
+}
+
+func storedSliceId(category string, name string) (int, error) {
+	var id int
+	err := Db.QueryRow("SELECT id FROM slices WHERE category = ? AND name = ?", category, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	return id, err
+}
+
+// renameMetric renames the metrics row and moves its cache and registry entries, the id and data stay
+func renameMetric(from string, to string) error {
+	id, err := storedMetricId(from)
+	if err != nil {
+		return err
+	}
+	err = MCache.Rename(from, to, id, func() error {
+		_, err := Db.Exec("UPDATE metrics SET name = ?, name_crc_32 = ? WHERE id = ?", to, crc32.ChecksumIEEE([]byte(to)), id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if info, ok := MetricRegistry.Get(from); ok {
+		MetricRegistry.Remove(from)
+		info.Name = to
+		MetricRegistry.Set(info)
+	}
+	return nil
+}
+
+// renameSlice renames the slices row and moves its cache entry, the id and data stay
+func renameSlice(request sliceRenameRequest) error {
+	id, err := storedSliceId(request.Category, request.Name)
+	if err != nil {
+		return err
+	}
+	err = SlicesCache.Rename(sliceKey(request.Category, request.Name), sliceKey(request.NewCategory, request.NewName), id, func() error {
+		_, err := Db.Exec("UPDATE slices SET category = ?, category_crc_32 = ?, name = ?, name_crc_32 = ? WHERE id = ?",
+			request.NewCategory, crc32.ChecksumIEEE([]byte(request.NewCategory)),
+			request.NewName, crc32.ChecksumIEEE([]byte(request.NewName)), id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	Cardinality.Rename(request.Category, request.Name, request.NewCategory, request.NewName)
+	_, err = moveComposites(request.Category, request.Name, request.NewCategory, request.NewName, false)
+	return err
+}
+
+// moveComposites renames the composite slices built from the slice category:name to the composite slices
+// built from newCategory:newName, merging them into the ones that exist. It returns the reports of the merges
+func moveComposites(category string, name string, newCategory string, newName string, dryRun bool) ([]mergeReport, error) {
+	composites, err := compositeSlices(category, name)
+	if err != nil {
+		return nil, err
+	}
+	var reports []mergeReport
+	for _, composite := range composites {
+		categories := strings.Split(composite.category, combinationSeparator)
+		names := strings.Split(composite.name, combinationSeparator)
+		for i := range categories {
+			if categories[i] == category && names[i] == name {
+				categories[i], names[i] = newCategory, newName
+			}
+		}
+		into := sliceMergeRequest{Category: composite.category, Name: composite.name,
+			IntoCategory: combinationCategory(categories), IntoName: strings.Join(names, combinationSeparator), DryRun: dryRun}
+		_, err := storedSliceId(into.IntoCategory, into.IntoName)
+		if err == errNotFound {
+			if !dryRun {
+				err = renameSlice(sliceRenameRequest{Category: into.Category, Name: into.Name, NewCategory: into.IntoCategory, NewName: into.IntoName})
+			}
+			if err != nil {
+				return reports, err
+			}
+			continue
+		}
+		if err != nil {
+			return reports, err
+		}
+		report, err := mergeOneSlice(into)
+		if len(report.Tables) > 0 || err != nil {
+			reports = append(reports, report)
+		}
+		if err != nil {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
+
+// invalidNewSlice reports whether category:name may not be renamed to newCategory:newName: the new names
+// must be valid and have the combination separator only where the renamed slice has it
+func invalidNewSlice(category string, name string, newCategory string, newName string) bool {
+	if expression := Conf().SliceNameValidationRegexp; expression != "" {
+		invalidName, err := regexp.Compile(expression)
+		if err != nil || invalidSliceName(invalidName, newCategory, newName) {
+			return true
+		}
+	}
+	if strings.Contains(newCategory, sliceKeySeparator) || strings.Contains(newName, sliceKeySeparator) {
+		return true
+	}
+	parts := strings.Count(category, combinationSeparator)
+	return strings.Count(newCategory, combinationSeparator) != parts || strings.Count(newName, combinationSeparator) != parts ||
+		strings.Count(name, combinationSeparator) != parts
+}
+
+// mergeMetric re-sums all rows of metric from into metric into and deletes from.
+// The cache keeps resolving from to the id of into until restart, and rows of events resolved to the id
+// of from before are written under the id of into, so its late events are not lost. Flushes are paused
+// while the rows are moved
+func mergeMetric(from string, into string, dryRun bool) (mergeReport, error) {
+	report := mergeReport{DryRun: dryRun, Tables: []mergedTable{}}
+	var err error
+	if report.FromId, err = storedMetricId(from); err != nil {
+		return report, err
+	}
+	if report.IntoId, err = storedMetricId(into); err != nil {
+		return report, err
+	}
+	if report.FromId == report.IntoId {
+		return report, errors.New("cannot merge a metric into itself")
+	}
+	if !dryRun {
+		MCache.Set(from, report.IntoId)
+		MergedIds.set(&MergedIds.metrics, report.FromId, report.IntoId)
+		flushAllStorages()
+		FlushPipeline.Pause()
+		defer FlushPipeline.Resume()
+	}
+	for _, family := range tableFamilies {
+		tables, err := mergeRows(family, "metric_id", report.FromId, report.IntoId, dryRun)
+		report.Tables = append(report.Tables, tables...)
+		if err != nil {
+			return report, err
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	if _, err := Db.Exec("DELETE FROM metrics WHERE id = ?", report.FromId); err != nil {
+		return report, err
+	}
+	MetricRegistry.Remove(from)
+	return report, nil
+}
+
+// mergeSlice is mergeMetric for slices, for all metrics having the slice. The composite slices built from
+// the slice are merged into, or renamed to, the composite slices built from the slice it is merged into
+func mergeSlice(request sliceMergeRequest) (mergeReport, error) {
+	report, err := mergeOneSlice(request)
+	if err != nil {
+		return report, err
+	}
+	report.Composites, err = moveComposites(request.Category, request.Name, request.IntoCategory, request.IntoName, request.DryRun)
+	return report, err
+}
+
+func mergeOneSlice(request sliceMergeRequest) (mergeReport, error) {
+	report := mergeReport{DryRun: request.DryRun, Tables: []mergedTable{}}
+	var err error
+	if report.FromId, err = storedSliceId(request.Category, request.Name); err != nil {
+		return report, err
+	}
+	if report.IntoId, err = storedSliceId(request.IntoCategory, request.IntoName); err != nil {
+		return report, err
+	}
+	if report.FromId == report.IntoId {
+		return report, errors.New("cannot merge a slice into itself")
+	}
+	if !request.DryRun {
+		SlicesCache.Set(sliceKey(request.Category, request.Name), report.IntoId)
+		MergedIds.set(&MergedIds.slices, report.FromId, report.IntoId)
+		flushAllStorages()
+		FlushPipeline.Pause()
+		defer FlushPipeline.Resume()
+	}
+	for _, family := range tableFamilies {
+		if !family.slices {
+			continue
+		}
+		tables, err := mergeRows(family, "slice_id", report.FromId, report.IntoId, request.DryRun)
+		report.Tables = append(report.Tables, tables...)
+		if err != nil {
+			return report, err
+		}
+	}
+	if request.DryRun {
+		return report, nil
+	}
+	if _, err := Db.Exec("DELETE FROM slices WHERE id = ?", report.FromId); err != nil {
+		return report, err
+	}
+	Cardinality.Forget(request.Category, request.Name)
+	return report, nil
+}
+
+// mergeRows moves the rows having column = fromId to intoId in every table of the family,
+// adding their values to the rows intoId already has for the same key
+func mergeRows(family tableFamily, column string, fromId int, intoId int, dryRun bool) ([]mergedTable, error) {
+	tables, err := family.tables()
+	if err != nil {
+		return nil, err
+	}
+	columns := append(family.idColumns(), family.keyColumns...)
+	selectColumns := make([]string, 0, len(columns))
+	for _, name := range columns {
+		if name == column {
+			selectColumns = append(selectColumns, "? AS `"+name+"`")
+		} else {
+			selectColumns = append(selectColumns, "`"+name+"`")
+		}
+	}
+
+	var merged []mergedTable
+	for _, tableName := range tables {
+		report := mergedTable{Table: tableName}
+		err := Db.QueryRow("SELECT COUNT(*), COALESCE(SUM(`value`), 0), COALESCE(SUM(`value_float`), 0) FROM `"+tableName+
+			"` WHERE `"+column+"` = ?", fromId).Scan(&report.Rows, &report.Value, &report.ValueFloat)
+		if err != nil {
+			return merged, err
+		}
+		if report.Rows == 0 {
+			continue
+		}
+		if dryRun {
+			merged = append(merged, report)
+			continue
+		}
+
+		slog.Info("Merging", "table", tableName, "column", column, "from", fromId, "into", intoId, "rows", report.Rows)
+		tx, err := Db.Begin()
+		if err != nil {
+			return merged, err
+		}
+		//selecting from the derived table src keeps `value` unambiguous in ON DUPLICATE KEY UPDATE
+		_, err = tx.Exec("INSERT INTO `"+tableName+"` (`"+strings.Join(columns, "`,`")+"`, `value`, `value_float`) "+
+			"SELECT src.* FROM (SELECT "+strings.Join(selectColumns, ", ")+", `value`, `value_float` FROM `"+tableName+"` "+
+			"WHERE `"+column+"` = ?) AS src "+
+			"ON DUPLICATE KEY UPDATE `"+tableName+"`.`value` = `"+tableName+"`.`value` + src.`value`, "+
+			"`"+tableName+"`.`value_float` = `"+tableName+"`.`value_float` + src.`value_float`",
+			intoId, fromId)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM `"+tableName+"` WHERE `"+column+"` = ?", fromId)
+		}
+		if err != nil {
+			tx.Rollback()
+			return merged, err
+		}
+		if err := tx.Commit(); err != nil {
+			return merged, err
+		}
+		merged = append(merged, report)
+	}
+	return merged, nil
+}
+
+// mergeError answers a failed merge with the tables merged before the failure
+func mergeError(c *gin.Context, report mergeReport, err error) {
+	if err == errNotFound || len(report.Tables) == 0 && len(report.Composites) == 0 {
+		adminError(c, err)
+		return
+	}
+	slog.Error("Merge failed partway", "path", c.FullPath(), "from", report.FromId, "into", report.IntoId, "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":  err.Error(),
+		"merged": report,
+		"resume": "run the merge again to merge the remaining tables",
+	})
+}
+
+func adminError(c *gin.Context, err error) {
+	if err == errNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	slog.Error("Admin request failed", "path", c.FullPath(), "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func renameMetricHandler(c *gin.Context) {
+	var request metricRenameRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r, err := regexp.Compile(Conf().MetricNameValidationRegexp)
+	if err != nil || request.From == "" || request.To == "" || r.MatchString(request.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and a valid to are required"})
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if _, err := storedMetricId(request.To); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "metric " + request.To + " exists, merge instead"})
+		return
+	}
+	if err := renameMetric(request.From, request.To); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": request.From, "to": request.To})
+}
+
+func mergeMetricHandler(c *gin.Context) {
+	var request metricMergeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.From == "" || request.Into == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and into are required"})
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	report, err := mergeMetric(request.From, request.Into, request.DryRun)
+	if err != nil {
+		mergeError(c, report, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func renameSliceHandler(c *gin.Context) {
+	var request sliceRenameRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil || request.Category == "" || request.Name == "" || request.NewCategory == "" || request.NewName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category, name, newCategory and newName are required"})
+		return
+	}
+	if invalidNewSlice(request.Category, request.Name, request.NewCategory, request.NewName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "newCategory and newName are not a valid slice"})
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if _, err := storedSliceId(request.NewCategory, request.NewName); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "slice " + request.NewCategory + ":" + request.NewName + " exists, merge instead"})
+		return
+	}
+	if err := renameSlice(request); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, request)
+}
+
+func mergeSliceHandler(c *gin.Context) {
+	var request sliceMergeRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil || request.Category == "" || request.Name == "" || request.IntoCategory == "" || request.IntoName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category, name, intoCategory and intoName are required"})
+		return
+	}
+	if invalidNewSlice(request.Category, request.Name, request.IntoCategory, request.IntoName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "intoCategory and intoName are not a valid slice"})
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	report, err := mergeSlice(request)
+	if err != nil {
+		mergeError(c, report, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultRetentionCheckInterval = 3600
+
+type retentionReport struct {
+	StartedAt time.Time `json:"startedAt"`
+	Dropped   []string  `json:"dropped"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// retentionJanitor drops daily tables older than the retention of their family
+type retentionJanitor struct {
+	mu         sync.Mutex
+	lastReport *retentionReport
+}
+
+var Janitor retentionJanitor
+
+// Start runs the janitor now and then every Conf.Retention.CheckInterval seconds
+func (janitor *retentionJanitor) Start() {
+	interval := Conf().Retention.CheckInterval
+	if interval <= 0 {
+		interval = defaultRetentionCheckInterval
+	}
+	go func() {
+		janitor.Run()
+		for range time.Tick(time.Duration(interval) * time.Second) {
+			janitor.Run()
+		}
+	}()
+}
+
+// Run drops the expired tables of every daily family with a retention. It holds adminMu, so
+// purges and merges never work on a table being dropped
+func (janitor *retentionJanitor) Run() retentionReport {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	report := retentionReport{StartedAt: time.Now(), Dropped: []string{}}
+	for _, family := range tableFamilies {
+		days := Conf().Retention.Days[family.name]
+		if !family.daily() || days <= 0 {
+			continue
+		}
+		dropped, err := dropExpiredTables(family, days, report.StartedAt)
+		report.Dropped = append(report.Dropped, dropped...)
+		if err != nil {
+			slog.Error("Retention failed", "family", family.name, "days", days, "error", err)
+			report.Error = err.Error()
+		}
+	}
+	if len(report.Dropped) > 0 {
+		slog.Info("Retention dropped tables", "tables", report.Dropped, "count", len(report.Dropped))
+	}
+	janitor.mu.Lock()
+	janitor.lastReport = &report
+	janitor.mu.Unlock()
+	return report
+}
+
+// LastReport returns the report of the last run, nil before the first one
+func (janitor *retentionJanitor) LastReport() *retentionReport {
+	janitor.mu.Lock()
+	defer janitor.mu.Unlock()
+	return janitor.lastReport
+}
+
+// dropExpiredTables drops the tables of the family holding dates more than days before now
+func dropExpiredTables(family tableFamily, days int, now time.Time) ([]string, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	cutoff := today.AddDate(0, 0, -days)
+	tables, err := family.dailyTables()
+	if err != nil {
+		return nil, err
+	}
+	var dropped []string
+	for _, table := range tables {
+		if !table.date.Before(cutoff) {
+			break
+		}
+		if _, err := Db.Exec("DROP TABLE IF EXISTS `" + table.name + "`"); err != nil {
+			return dropped, err
+		}
+		Schema.Forget(table.name)
+		dropped = append(dropped, table.name)
+	}
+	return dropped, nil
+}
+
+// retentionHandler returns the retention settings and the last janitor report, POST runs the janitor now
+func retentionHandler(c *gin.Context) {
+	var report *retentionReport
+	if c.Request.Method == http.MethodPost {
+		runReport := Janitor.Run()
+		report = &runReport
+	} else {
+		report = Janitor.LastReport()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"days":       Conf().Retention.Days,
+		"lastReport": report,
+	})
+}
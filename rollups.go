@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRollupInterval = 600
+	//days a rebuild requested through the admin endpoint may cover
+	maxRollupRebuildDays = 366
+)
+
+// rollupPeriod is an aggregation level of the rollup tables, rollup_<period>_metrics and rollup_<period>_slices.
+// Hourly rows are built from the per-minute tables, longer periods from the hourly rows, so they
+// can still be rebuilt after the retention dropped the per-minute tables
+type rollupPeriod struct {
+	name  string
+	start func(date time.Time) time.Time
+	end   func(start time.Time) time.Time
+}
+
+// rollupMu serializes rebuilds from the ticker and from the admin endpoint
+var rollupMu sync.Mutex
+
+var (
+	weeklyRollup = rollupPeriod{
+		name: "weekly",
+		start: func(date time.Time) time.Time {
+			return date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7))
+		},
+		end: func(start time.Time) time.Time { return start.AddDate(0, 0, 6) },
+	}
+	monthlyRollup = rollupPeriod{
+		name: "monthly",
+		start: func(date time.Time) time.Time {
+			return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.Local)
+		},
+		end: func(start time.Time) time.Time { return start.AddDate(0, 1, -1) },
+	}
+	rollupPeriods = []rollupPeriod{weeklyRollup, monthlyRollup}
+	rollupSources = []tableFamily{DailyMetricsFamily, DailySlicesFamily}
+)
+
+// rollupDays collects the days written by flushes of the rollup sources, late events and backfills
+// included, until the ticker rebuilds their rollups
+type rollupDays struct {
+	mu   sync.Mutex
+	days map[int32]struct{}
+}
+
+var RollupDays rollupDays
+
+func isRollupSource(family tableFamily) bool {
+	for _, source := range rollupSources {
+		if source.name == family.name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add collects days as yyyymmdd
+func (set *rollupDays) Add(days ...int32) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.days == nil {
+		set.days = make(map[int32]struct{})
+	}
+	for _, day := range days {
+		set.days[day] = struct{}{}
+	}
+}
+
+// Take returns the collected days as dates, oldest first, and forgets them
+func (set *rollupDays) Take() []time.Time {
+	set.mu.Lock()
+	days := set.days
+	set.days = nil
+	set.mu.Unlock()
+	dates := make([]time.Time, 0, len(days))
+	for day := range days {
+		dates = append(dates, dayDate(day))
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	return dates
+}
+
+func rollupTableName(period string, source tableFamily) string {
+	if source.slices {
+		return "rollup_" + period + "_slices"
+	}
+	return "rollup_" + period + "_metrics"
+}
+
+func createRollupTables() {
+	for _, source := range rollupSources {
+		idColumns := source.idColumns()
+		columnsSql := ""
+		for _, column := range idColumns {
+			columnsSql += "`" + column + "` int(10) unsigned NOT NULL,"
+		}
+		keySql := "`" + strings.Join(idColumns, "`,`") + "`"
+
+		tableName := rollupTableName("hourly", source)
+		createRollupTable(tableName, "CREATE TABLE IF NOT EXISTS `"+tableName+"` ("+
+			"`id` int(10) unsigned NOT NULL AUTO_INCREMENT,"+
+			columnsSql+
+			"`date` date NOT NULL,"+
+			"`hour` tinyint(3) unsigned NOT NULL,"+
+			"`value` bigint(20) NOT NULL,"+
+			"`value_float` double NOT NULL DEFAULT '0',"+
+			"PRIMARY KEY (`id`),"+
+			"UNIQUE KEY `"+tableName+"_unique` ("+keySql+",`date`,`hour`),"+
+			"KEY `"+tableName+"_date_index` (`date`)"+
+			") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci")
+
+		for _, period := range rollupPeriods {
+			tableName := rollupTableName(period.name, source)
+			createRollupTable(tableName, "CREATE TABLE IF NOT EXISTS `"+tableName+"` ("+
+				"`id` int(10) unsigned NOT NULL AUTO_INCREMENT,"+
+				columnsSql+
+				"`date` date NOT NULL,"+
+				"`value` bigint(20) NOT NULL,"+
+				"`value_float` double NOT NULL DEFAULT '0',"+
+				"PRIMARY KEY (`id`),"+
+				"UNIQUE KEY `"+tableName+"_unique` ("+keySql+",`date`),"+
+				"KEY `"+tableName+"_date_index` (`date`)"+
+				") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci")
+		}
+	}
+}
+
+func createRollupTable(tableName string, sqlStr string) {
+	if _, err := Db.Exec(sqlStr); err != nil {
+		fatal("Cannot create table", "table", tableName, "error", err)
+	}
+}
+
+// startRollups rebuilds the rollups of the days written by flushes every Conf.Rollup.Interval seconds.
+// The days late events may have been written to before a restart are rebuilt first, today and
+// yesterday at least
+func startRollups() {
+	conf := Conf()
+	interval := conf.Rollup.Interval
+	if interval <= 0 {
+		interval = defaultRollupInterval
+	}
+	now := time.Now()
+	lateness := time.Duration(conf.Acceptance.MaxEventLateness) * time.Second
+	if lateness < 24*time.Hour {
+		lateness = 24 * time.Hour
+	}
+	for date := now.Add(-lateness); !date.After(now); date = date.AddDate(0, 0, 1) {
+		RollupDays.Add(dateDay(date))
+	}
+	RollupDays.Add(dateDay(now))
+	go func() {
+		for range time.Tick(time.Duration(interval) * time.Second) {
+			dates := RollupDays.Take()
+			if len(dates) == 0 {
+				continue
+			}
+			if err := rebuildRollupDates(dates); err != nil {
+				slog.Error("Rollups failed", "from", dates[0].Format("2006-01-02"), "to", dates[len(dates)-1].Format("2006-01-02"), "error", err)
+				//retried with the next tick
+				for _, date := range dates {
+					RollupDays.Add(dateDay(date))
+				}
+			}
+		}
+	}()
+}
+
+// rebuildRollups recomputes the hourly rollups of every date in [from, to], then the weekly and
+// monthly rollups of the periods containing them
+func rebuildRollups(from time.Time, to time.Time) error {
+	if to.Before(from) {
+		return errors.New("to is before from")
+	}
+	var dates []time.Time
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		dates = append(dates, date)
+	}
+	return rebuildRollupDates(dates)
+}
+
+// rebuildRollupDates recomputes the hourly rollups of the dates, sorted, then the weekly and monthly
+// rollups of the periods containing them, once per period
+func rebuildRollupDates(dates []time.Time) error {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	startTime := time.Now()
+	for _, source := range rollupSources {
+		for _, date := range dates {
+			if err := buildHourlyRollup(source, date); err != nil {
+				return err
+			}
+		}
+		for _, period := range rollupPeriods {
+			built := make(map[time.Time]bool)
+			for _, date := range dates {
+				start := period.start(date)
+				if built[start] {
+					continue
+				}
+				built[start] = true
+				if err := buildPeriodRollup(source, period, start); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	slog.Info("Rollups built", "from", dates[0].Format("2006-01-02"), "to", dates[len(dates)-1].Format("2006-01-02"),
+		"dates", len(dates), "elapsed", time.Since(startTime))
+	return nil
+}
+
+// buildHourlyRollup replaces the hourly rows of the date by sums of its per-minute table.
+// Dates without a per-minute table, e.g. dropped by the retention, keep their rows
+func buildHourlyRollup(source tableFamily, date time.Time) error {
+	sourceTable := source.tableName(date.Format("2006_01_02"))
+	exists, err := tableExists(sourceTable)
+	if err != nil || !exists {
+		return err
+	}
+	idColumns := "`" + strings.Join(source.idColumns(), "`,`") + "`"
+	dateStr := date.Format("2006-01-02")
+	tableName := rollupTableName("hourly", source)
+	return replaceRollupRows(tableName, "`date` = ?", []interface{}{dateStr},
+		"INSERT INTO `"+tableName+"` ("+idColumns+", `date`, `hour`, `value`, `value_float`) "+
+			"SELECT "+idColumns+", ?, `minute` DIV 60, SUM(`value`), SUM(`value_float`) FROM `"+sourceTable+"` "+
+			"GROUP BY "+idColumns+", `minute` DIV 60", dateStr)
+}
+
+// buildPeriodRollup replaces the rows of the period starting at start by sums of the hourly rows
+func buildPeriodRollup(source tableFamily, period rollupPeriod, start time.Time) error {
+	idColumns := "`" + strings.Join(source.idColumns(), "`,`") + "`"
+	startStr := start.Format("2006-01-02")
+	tableName := rollupTableName(period.name, source)
+	return replaceRollupRows(tableName, "`date` = ?", []interface{}{startStr},
+		"INSERT INTO `"+tableName+"` ("+idColumns+", `date`, `value`, `value_float`) "+
+			"SELECT "+idColumns+", ?, SUM(`value`), SUM(`value_float`) FROM `"+rollupTableName("hourly", source)+"` "+
+			"WHERE `date` BETWEEN ? AND ? GROUP BY "+idColumns,
+		startStr, startStr, period.end(start).Format("2006-01-02"))
+}
+
+func replaceRollupRows(tableName string, where string, whereArgs []interface{}, insertSql string, insertArgs ...interface{}) error {
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM `"+tableName+"` WHERE "+where, whereArgs...)
+	if err == nil {
+		_, err = tx.Exec(insertSql, insertArgs...)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func parseRollupRange(fromStr string, toStr string) (time.Time, time.Time, error) {
+	from, err := time.ParseInLocation("2006-01-02", fromStr, time.Local)
+	if err != nil {
+		return from, from, err
+	}
+	if toStr == "" {
+		return from, from, nil
+	}
+	to, err := time.ParseInLocation("2006-01-02", toStr, time.Local)
+	return from, to, err
+}
+
+// rollupRebuildHandler serves POST /admin/rollups/rebuild?from=2017-07-01&to=2017-07-14
+func rollupRebuildHandler(c *gin.Context) {
+	from, to, err := parseRollupRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from (and to) must be YYYY-MM-DD"})
+		return
+	}
+	if to.Before(from) || to.Sub(from) >= maxRollupRebuildDays*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must cover 1 to " + strconv.Itoa(maxRollupRebuildDays) + " days"})
+		return
+	}
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	if err := rebuildRollups(from, to); err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from.Format("2006-01-02"), "to": to.Format("2006-01-02")})
+}
+
+// runRollupCommand is `realmetric rollup -from 2017-07-01 [-to 2017-07-14]`
+func runRollupCommand(args []string) error {
+	flags := flag.NewFlagSet("rollup", flag.ExitOnError)
+	fromStr := flags.String("from", "", "first date to rebuild, YYYY-MM-DD")
+	toStr := flags.String("to", "", "last date to rebuild, YYYY-MM-DD, defaults to from")
+	flags.Parse(args)
+	from, to, err := parseRollupRange(*fromStr, *toStr)
+	if err != nil {
+		return err
+	}
+	return rebuildRollups(from, to)
+}
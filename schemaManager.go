@@ -0,0 +1,173 @@
+package main
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const defaultPrecreateTablesAt = "23:00"
+
+func dailyMetricsSchema(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName +
+		" (`id` int(10) unsigned NOT NULL AUTO_INCREMENT," +
+		"`metric_id` int(10) unsigned NOT NULL," +
+		"`value` bigint(20) NOT NULL," +
+		"`value_float` double NOT NULL DEFAULT '0'," +
+		"`minute` smallint(5) unsigned NOT NULL," +
+		"PRIMARY KEY (`id`)," +
+		"UNIQUE KEY " + tableName + "_metric_id_minute_unique (`metric_id`,`minute`)," +
+		"KEY " + tableName + "_metric_id_index (`metric_id`)" +
+		") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
+}
+
+func dailyMetricTotalsSchema(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName +
+		" (`id` int(10) unsigned NOT NULL AUTO_INCREMENT," +
+		"`metric_id` int(10) unsigned NOT NULL," +
+		"`value` bigint(20) NOT NULL," +
+		"`value_float` double NOT NULL DEFAULT '0'," +
+		"`diff` float NOT NULL DEFAULT '0'," +
+		"PRIMARY KEY (`id`)," +
+		"UNIQUE KEY " + tableName + "_metric_id_unique (`metric_id`)" +
+		") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
+}
+
+func dailySlicesSchema(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName +
+		" (`id` int(10) unsigned NOT NULL AUTO_INCREMENT," +
+		"`metric_id` int(10) unsigned NOT NULL," +
+		"`slice_id` int(10) unsigned NOT NULL," +
+		"`value` bigint(20) NOT NULL," +
+		"`value_float` double NOT NULL DEFAULT '0'," +
+		"`minute` smallint(5) unsigned NOT NULL," +
+		"PRIMARY KEY (`id`)," +
+		"UNIQUE KEY " + tableName + "_metric_id_slice_id_minute_unique (`metric_id`,`slice_id`,`minute`)," +
+		"KEY " + tableName + "_metric_id_slice_id_index (`metric_id`, `slice_id`)" +
+		") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
+}
+
+func dailySliceTotalsSchema(tableName string) string {
+	return "CREATE TABLE IF NOT EXISTS " + tableName +
+		" (`id` int(10) unsigned NOT NULL AUTO_INCREMENT," +
+		"`metric_id` int(10) unsigned NOT NULL," +
+		"`slice_id` int(10) unsigned NOT NULL," +
+		"`value` bigint(20) NOT NULL," +
+		"`value_float` double NOT NULL DEFAULT '0'," +
+		"`diff` float NOT NULL DEFAULT '0'," +
+		"PRIMARY KEY (`id`)," +
+		"UNIQUE KEY " + tableName + "_metric_id_slice_id_unique (`metric_id`,`slice_id`)" +
+		") ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci"
+}
+
+// schemaManager knows which daily tables exist. Tables are created ahead of time, so flushes
+// only check the cache; Ensure creates a missing table, e.g. for a backfilled date. A table dropped
+// behind its back, by another instance or the retention, is forgotten when an insert misses it
+type schemaManager struct {
+	mu       sync.Mutex
+	existing map[string]bool
+}
+
+var Schema schemaManager
+
+// Load caches the aggregate tables existing in the database
+func (schema *schemaManager) Load() error {
+	tables, err := aggregateTables()
+	if err != nil {
+		return err
+	}
+	schema.mu.Lock()
+	schema.existing = make(map[string]bool, len(tables))
+	for _, tableName := range tables {
+		schema.existing[tableName] = true
+	}
+	schema.mu.Unlock()
+	return nil
+}
+
+// Ensure creates the table of the family for the date key unless it is known to exist. The DDL runs
+// without the lock, CREATE TABLE IF NOT EXISTS of the same table by concurrent flushes is harmless
+func (schema *schemaManager) Ensure(family tableFamily, dateKey string) error {
+	tableName := family.tableName(dateKey)
+	schema.mu.Lock()
+	exists := schema.existing[tableName]
+	schema.mu.Unlock()
+	if exists {
+		return nil
+	}
+	if _, err := Db.Exec(family.schema(tableName)); err != nil {
+		return err
+	}
+	schema.mu.Lock()
+	if schema.existing == nil {
+		schema.existing = make(map[string]bool)
+	}
+	schema.existing[tableName] = true
+	schema.mu.Unlock()
+	return nil
+}
+
+// isMissingTable reports MySQL error 1146, table doesn't exist
+func isMissingTable(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1146
+}
+
+// EnsureDate creates the tables of every daily family for the date
+func (schema *schemaManager) EnsureDate(date time.Time) error {
+	dateKey := date.Format("2006_01_02")
+	for _, family := range dailyFamilies {
+		if err := schema.Ensure(family, dateKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget removes a dropped table from the cache
+func (schema *schemaManager) Forget(tableName string) {
+	schema.mu.Lock()
+	delete(schema.existing, tableName)
+	schema.mu.Unlock()
+}
+
+// Start creates the tables of today and tomorrow now, then tomorrow's tables every day at
+// Conf.Schema.PrecreateTablesAt (HH:MM, local time)
+func (schema *schemaManager) Start() {
+	if err := schema.Load(); err != nil {
+		slog.Error("Cannot load existing tables", "error", err)
+	}
+	now := time.Now()
+	for _, date := range []time.Time{now, now.AddDate(0, 0, 1)} {
+		if err := schema.EnsureDate(date); err != nil {
+			slog.Error("Cannot create tables", "date", date.Format("2006-01-02"), "error", err)
+		}
+	}
+
+	at := Conf().Schema.PrecreateTablesAt
+	if at == "" {
+		at = defaultPrecreateTablesAt
+	}
+	clock, err := time.Parse("15:04", at)
+	if err != nil {
+		slog.Warn("Invalid Schema.PrecreateTablesAt", "value", at, "default", defaultPrecreateTablesAt)
+		clock, _ = time.Parse("15:04", defaultPrecreateTablesAt)
+	}
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(next.Sub(now))
+			tomorrow := time.Now().AddDate(0, 0, 1)
+			if err := schema.EnsureDate(tomorrow); err != nil {
+				slog.Error("Cannot create tables", "date", tomorrow.Format("2006-01-02"), "error", err)
+			} else {
+				slog.Info("Created tables", "date", tomorrow.Format("2006-01-02"))
+			}
+		}
+	}()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// combinationSeparator joins the categories and the names of a slice combination,
+// e.g. country=US and platform=ios are aggregated as the slice "country|platform" = "US|ios"
+const combinationSeparator = "|"
+
+func combinationCategory(categories []string) string {
+	return strings.Join(categories, combinationSeparator)
+}
+
+// invalidSliceName reports whether invalidName, the SliceNameValidationRegexp, matches the name of the slice.
+// Composite slices are checked name by name, the separator is not part of any of them
+func invalidSliceName(invalidName *regexp.Regexp, category string, name string) bool {
+	if !strings.Contains(category, combinationSeparator) {
+		return invalidName.MatchString(name)
+	}
+	for _, part := range strings.Split(name, combinationSeparator) {
+		if invalidName.MatchString(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandCombinations adds composite slices for the combinations declared for the metric in
+// Conf.SliceCombinations. Events missing one of the categories of a combination skip it
+func expandCombinations(conf *Config, event Event) {
+	combinations := conf.SliceCombinations[event.Metric]
+	if len(combinations) == 0 || event.Slices == nil {
+		return
+	}
+	for _, categories := range combinations {
+		names := make([]string, 0, len(categories))
+		for _, category := range categories {
+			name, ok := event.Slices[category]
+			if !ok {
+				break
+			}
+			if strings.Contains(name, combinationSeparator) {
+				logSampled(slog.LevelWarn, "Skip combination", "metric", event.Metric, "category", combinationCategory(categories), "slice", name)
+				break
+			}
+			names = append(names, name)
+		}
+		if len(names) != len(categories) {
+			continue
+		}
+		event.Slices[combinationCategory(categories)] = strings.Join(names, combinationSeparator)
+	}
+}
+
+// matchSliceFilter finds the slice category answering the filters of a query: the category itself for
+// a single filter, otherwise the smallest declared combination containing every filtered category.
+// It returns the category and a LIKE pattern for names, where categories of the combination missing
+// from the filters match anything
+func matchSliceFilter(conf *Config, metric string, filters map[string]string) (string, string, bool) {
+	if len(filters) == 1 {
+		for category, name := range filters {
+			return category, escapeLike(name), true
+		}
+	}
+	var found []string
+	for _, categories := range conf.SliceCombinations[metric] {
+		covered := 0
+		for _, category := range categories {
+			if _, ok := filters[category]; ok {
+				covered++
+			}
+		}
+		if covered == len(filters) && (found == nil || len(categories) < len(found)) {
+			found = categories
+		}
+	}
+	if found == nil {
+		return "", "", false
+	}
+	patterns := make([]string, 0, len(found))
+	for _, category := range found {
+		if name, ok := filters[category]; ok {
+			patterns = append(patterns, escapeLike(name))
+		} else {
+			patterns = append(patterns, "%")
+		}
+	}
+	return combinationCategory(found), strings.Join(patterns, combinationSeparator), true
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
+// sliceQueryHandler returns the daily total of a metric filtered by one or several slice categories:
+// GET /slices/query?metric=purchase&date=2017-07-14&country=US&platform=ios
+func sliceQueryHandler(c *gin.Context) {
+	metric := c.Query("metric")
+	date, err := time.Parse("2006-01-02", c.Query("date"))
+	if metric == "" || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metric and date (YYYY-MM-DD) are required"})
+		return
+	}
+	filters := make(map[string]string)
+	for category, names := range c.Request.URL.Query() {
+		if category == "metric" || category == "date" || len(names) == 0 {
+			continue
+		}
+		filters[category] = names[0]
+	}
+	if len(filters) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one slice filter is required"})
+		return
+	}
+
+	metricId, ok := MCache.Get(metric)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown metric " + metric})
+		return
+	}
+	category, namePattern, ok := matchSliceFilter(Conf(), metric, filters)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no slice combination of " + metric + " covers the filters"})
+		return
+	}
+
+	var value int64
+	var valueFloat float64
+	var slices int
+	err = Db.QueryRow("SELECT COALESCE(SUM(t.value), 0), COALESCE(SUM(t.value_float), 0), COUNT(*) "+
+		"FROM daily_slice_totals_"+date.Format("2006_01_02")+" t JOIN slices s ON s.id = t.slice_id "+
+		"WHERE t.metric_id = ? AND s.category = BINARY ? AND s.name LIKE BINARY ?", metricId, category, namePattern).
+		Scan(&value, &valueFloat, &slices)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1146 {
+		//no table, no events that day
+		err = nil
+	}
+	if err != nil {
+		slog.Error("Slice query failed", "table", "daily_slice_totals_"+date.Format("2006_01_02"), "metric", metric, "category", category, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"metric":     metric,
+		"date":       date.Format("2006-01-02"),
+		"category":   category,
+		"slices":     slices,
+		"value":      value,
+		"valueFloat": valueFloat,
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func combinationsConfig() *Config {
+	return &Config{SliceCombinations: map[string][][]string{
+		"purchase": {{"country", "platform"}, {"country", "platform", "version"}},
+	}}
+}
+
+func TestExpandCombinations(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		slices map[string]string
+		want   map[string]string
+	}{
+		{"all categories", "purchase",
+			map[string]string{"country": "US", "platform": "ios", "version": "2"},
+			map[string]string{"country": "US", "platform": "ios", "version": "2",
+				"country|platform": "US|ios", "country|platform|version": "US|ios|2"}},
+		{"missing category skips the combination", "purchase",
+			map[string]string{"country": "US", "platform": "ios"},
+			map[string]string{"country": "US", "platform": "ios", "country|platform": "US|ios"}},
+		{"separator in a name skips the combination", "purchase",
+			map[string]string{"country": "US|CA", "platform": "ios"},
+			map[string]string{"country": "US|CA", "platform": "ios"}},
+		{"no combination declared", "login",
+			map[string]string{"country": "US", "platform": "ios"},
+			map[string]string{"country": "US", "platform": "ios"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := Event{Metric: test.metric, Slices: test.slices}
+			expandCombinations(combinationsConfig(), event)
+			if !reflect.DeepEqual(event.Slices, test.want) {
+				t.Errorf("expandCombinations() slices = %v, want %v", event.Slices, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchSliceFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   string
+		filters  map[string]string
+		category string
+		pattern  string
+		ok       bool
+	}{
+		{"single category", "purchase", map[string]string{"country": "US"}, "country", "US", true},
+		{"single category escaped", "purchase", map[string]string{"version": "1_0%"}, "version", "1\\_0\\%", true},
+		{"exact combination", "purchase", map[string]string{"country": "US", "platform": "ios"},
+			"country|platform", "US|ios", true},
+		{"smallest covering combination", "purchase", map[string]string{"country": "US", "version": "2"},
+			"country|platform|version", "US|%|2", true},
+		{"no covering combination", "purchase", map[string]string{"country": "US", "city": "NYC"}, "", "", false},
+		{"no combination declared", "login", map[string]string{"country": "US", "platform": "ios"}, "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			category, pattern, ok := matchSliceFilter(combinationsConfig(), test.metric, test.filters)
+			if category != test.category || pattern != test.pattern || ok != test.ok {
+				t.Errorf("matchSliceFilter() = %q, %q, %v, want %q, %q, %v",
+					category, pattern, ok, test.category, test.pattern, test.ok)
+			}
+		})
+	}
+}
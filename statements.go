@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+const defaultStatementCacheSize = 64
+
+// statementCache keeps prepared statements of full insert portions, the same for every flush of a
+// table, and evicts the least recently used one beyond Conf.Flush.StatementCacheSize. Statements are
+// counted while executing, an evicted one is closed by its last execution
+type statementCache struct {
+	mu    sync.Mutex
+	stmts map[string]*cachedStatement
+	order []string
+}
+
+type cachedStatement struct {
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+var Statements statementCache
+
+// get returns the statement of query, prepared outside the lock so a slow prepare does not hold up
+// the flushes of other tables. The caller releases it once executed
+func (cache *statementCache) get(ctx context.Context, query string) (*cachedStatement, error) {
+	cache.mu.Lock()
+	if cached, ok := cache.stmts[query]; ok {
+		cache.touch(query)
+		cached.refs++
+		cache.mu.Unlock()
+		return cached, nil
+	}
+	cache.mu.Unlock()
+	stmt, err := Db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cached, ok := cache.stmts[query]; ok {
+		//prepared concurrently by another flush
+		stmt.Close()
+		cache.touch(query)
+		cached.refs++
+		return cached, nil
+	}
+	if cache.stmts == nil {
+		cache.stmts = make(map[string]*cachedStatement)
+	}
+	cached := &cachedStatement{stmt: stmt, refs: 1}
+	cache.stmts[query] = cached
+	cache.order = append(cache.order, query)
+	size := Conf().Flush.StatementCacheSize
+	if size <= 0 {
+		size = defaultStatementCacheSize
+	}
+	for len(cache.order) > size {
+		evicted := cache.stmts[cache.order[0]]
+		evicted.evicted = true
+		if evicted.refs == 0 {
+			evicted.stmt.Close()
+		}
+		delete(cache.stmts, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	return cached, nil
+}
+
+// release ends an execution of the statement, closing it if it was evicted meanwhile
+func (cache *statementCache) release(cached *cachedStatement) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cached.refs--
+	if cached.evicted && cached.refs == 0 {
+		cached.stmt.Close()
+	}
+}
+
+func (cache *statementCache) touch(query string) {
+	for i, cached := range cache.order {
+		if cached == query {
+			cache.order = append(append(cache.order[:i:i], cache.order[i+1:]...), query)
+			return
+		}
+	}
+}
+
+// Exec runs query with args, within tx unless it is nil. Reusable statements come from the cache,
+// the others are prepared for this execution only
+func (cache *statementCache) Exec(ctx context.Context, tx *sql.Tx, query string, reusable bool, args []interface{}) error {
+	var stmt *sql.Stmt
+	var err error
+	if reusable {
+		cached, err := cache.get(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer cache.release(cached)
+		stmt = cached.stmt
+		if tx != nil {
+			stmt = tx.StmtContext(ctx, stmt)
+			defer stmt.Close()
+		}
+	} else {
+		if tx != nil {
+			stmt, err = tx.PrepareContext(ctx, query)
+		} else {
+			stmt, err = Db.PrepareContext(ctx, query)
+		}
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+	}
+	_, err = stmt.ExecContext(ctx, args...)
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// tableFamily describes a kind of aggregate table: one table per day named prefix+"2006_01_02",
+// or a single table like monthly_metrics. keyColumns complete metric_id (and slice_id) in the unique key,
+// schema returns the CREATE TABLE statement of a daily table
+type tableFamily struct {
+	name       string
+	prefix     string
+	table      string
+	slices     bool
+	keyColumns []string
+	schema     func(tableName string) string
+}
+
+var (
+	DailyMetricsFamily      = tableFamily{name: "DailyMetrics", prefix: "daily_metrics_", keyColumns: []string{"minute"}, schema: dailyMetricsSchema}
+	DailyMetricTotalsFamily = tableFamily{name: "DailyMetricTotals", prefix: "daily_metric_totals_", schema: dailyMetricTotalsSchema}
+	DailySlicesFamily       = tableFamily{name: "DailySlices", prefix: "daily_slices_", slices: true, keyColumns: []string{"minute"}, schema: dailySlicesSchema}
+	DailySliceTotalsFamily  = tableFamily{name: "DailySliceTotals", prefix: "daily_slice_totals_", slices: true, schema: dailySliceTotalsSchema}
+	MonthlyMetricsFamily    = tableFamily{name: "MonthlyMetrics", table: "monthly_metrics", keyColumns: []string{"date"}}
+	MonthlySlicesFamily     = tableFamily{name: "MonthlySlices", table: "monthly_slices", slices: true, keyColumns: []string{"date"}}
+
+	RollupHourlyMetricsFamily  = tableFamily{name: "RollupHourlyMetrics", table: "rollup_hourly_metrics", keyColumns: []string{"date", "hour"}}
+	RollupHourlySlicesFamily   = tableFamily{name: "RollupHourlySlices", table: "rollup_hourly_slices", slices: true, keyColumns: []string{"date", "hour"}}
+	RollupWeeklyMetricsFamily  = tableFamily{name: "RollupWeeklyMetrics", table: "rollup_weekly_metrics", keyColumns: []string{"date"}}
+	RollupWeeklySlicesFamily   = tableFamily{name: "RollupWeeklySlices", table: "rollup_weekly_slices", slices: true, keyColumns: []string{"date"}}
+	RollupMonthlyMetricsFamily = tableFamily{name: "RollupMonthlyMetrics", table: "rollup_monthly_metrics", keyColumns: []string{"date"}}
+	RollupMonthlySlicesFamily  = tableFamily{name: "RollupMonthlySlices", table: "rollup_monthly_slices", slices: true, keyColumns: []string{"date"}}
+)
+
+var dailyFamilies = []tableFamily{
+	DailyMetricsFamily,
+	DailyMetricTotalsFamily,
+	DailySlicesFamily,
+	DailySliceTotalsFamily,
+}
+
+// flushedFamilies are the families flushes insert into, the keys of Conf.Flush.BatchRows
+var flushedFamilies = []tableFamily{
+	DailyMetricsFamily,
+	DailyMetricTotalsFamily,
+	DailySlicesFamily,
+	DailySliceTotalsFamily,
+	MonthlyMetricsFamily,
+	MonthlySlicesFamily,
+}
+
+var tableFamilies = []tableFamily{
+	DailyMetricsFamily,
+	DailyMetricTotalsFamily,
+	DailySlicesFamily,
+	DailySliceTotalsFamily,
+	MonthlyMetricsFamily,
+	MonthlySlicesFamily,
+	RollupHourlyMetricsFamily,
+	RollupHourlySlicesFamily,
+	RollupWeeklyMetricsFamily,
+	RollupWeeklySlicesFamily,
+	RollupMonthlyMetricsFamily,
+	RollupMonthlySlicesFamily,
+}
+
+func (family tableFamily) daily() bool {
+	return family.prefix != ""
+}
+
+// tableName returns the table of the family for the date key, e.g. daily_metrics_2017_07_14
+func (family tableFamily) tableName(dateKey string) string {
+	if !family.daily() {
+		return family.table
+	}
+	return family.prefix + dateKey
+}
+
+// dailyTable is an existing table of a daily family with the date it holds
+type dailyTable struct {
+	name string
+	date time.Time
+}
+
+// dailyTables returns the existing tables of a daily family, sorted by date
+func (family tableFamily) dailyTables() ([]dailyTable, error) {
+	rows, err := Db.Query("SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() "+
+		"AND TABLE_NAME LIKE ? ORDER BY TABLE_NAME", strings.Replace(family.prefix, "_", "\\_", -1)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []dailyTable
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return nil, err
+		}
+		date, err := time.ParseInLocation("2006_01_02", strings.TrimPrefix(tableName, family.prefix), time.Local)
+		if err != nil {
+			//not a table of this family
+			continue
+		}
+		tables = append(tables, dailyTable{name: tableName, date: date})
+	}
+	return tables, rows.Err()
+}
+
+// tables returns the existing tables of the family
+func (family tableFamily) tables() ([]string, error) {
+	if !family.daily() {
+		return []string{family.table}, nil
+	}
+	daily, err := family.dailyTables()
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, 0, len(daily))
+	for _, table := range daily {
+		tables = append(tables, table.name)
+	}
+	return tables, nil
+}
+
+// idColumns returns the id columns of the family rows
+func (family tableFamily) idColumns() []string {
+	if family.slices {
+		return []string{"metric_id", "slice_id"}
+	}
+	return []string{"metric_id"}
+}
+
+// insertColumns returns the number of columns flushes insert per row: ids, values and key columns
+func (family tableFamily) insertColumns() int {
+	return len(family.idColumns()) + 2 + len(family.keyColumns)
+}
+
+func tableExists(tableName string) (bool, error) {
+	var count int
+	err := Db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", tableName).Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"time"
+)
+
+const (
+	//trust Event.Time
+	TimestampClient = "client"
+	//always stamp the receive time
+	TimestampServer = "server"
+	//keep Event.Time within Tolerance seconds of the receive time, stamp the receive time otherwise
+	TimestampTolerance = "tolerance"
+)
+
+const (
+	timestampModeHeader      = "X-Timestamp-Mode"
+	timestampToleranceHeader = "X-Timestamp-Tolerance"
+)
+
+// TimestampPolicy decides which time an event is bucketed by
+type TimestampPolicy struct {
+	Mode      string
+	Tolerance int
+}
+
+func validTimestampMode(mode string) bool {
+	return mode == TimestampClient || mode == TimestampServer || mode == TimestampTolerance
+}
+
+// timestampModeStrictness orders the modes from trusting the client most to least
+var timestampModeStrictness = map[string]int{TimestampClient: 0, TimestampTolerance: 1, TimestampServer: 2}
+
+// timestampPolicy returns the policy of the request: the X-Timestamp-Mode header or timestampMode
+// query parameter, then the policy of the authenticated account, then Conf.Timestamping.
+// A request of an account with a policy may only tighten it: a stricter mode or a smaller tolerance
+func timestampPolicy(c *gin.Context) TimestampPolicy {
+	conf := Conf()
+	policy := TimestampPolicy{Mode: conf.Timestamping.Mode, Tolerance: conf.Timestamping.Tolerance}
+	accountPolicy, restricted := conf.Timestamping.Accounts[c.GetString(gin.AuthUserKey)]
+	if restricted {
+		policy = accountPolicy
+	}
+	if !validTimestampMode(policy.Mode) {
+		policy.Mode = TimestampClient
+	}
+	mode := c.GetHeader(timestampModeHeader)
+	if mode == "" {
+		mode = c.Query("timestampMode")
+	}
+	tolerance := c.GetHeader(timestampToleranceHeader)
+	if tolerance == "" {
+		tolerance = c.Query("timestampTolerance")
+	}
+	seconds, err := strconv.Atoi(tolerance)
+	hasTolerance := err == nil && seconds >= 0
+
+	if !restricted {
+		if validTimestampMode(mode) {
+			policy.Mode = mode
+		}
+		if hasTolerance {
+			policy.Tolerance = seconds
+		}
+		return policy
+	}
+	switch {
+	case validTimestampMode(mode) && timestampModeStrictness[mode] > timestampModeStrictness[policy.Mode]:
+		if mode == TimestampTolerance && hasTolerance {
+			policy.Tolerance = seconds
+		}
+		policy.Mode = mode
+	case policy.Mode == TimestampTolerance && hasTolerance && seconds < policy.Tolerance:
+		policy.Tolerance = seconds
+	}
+	return policy
+}
+
+// stampEvents sets the time of the events according to the policy. Events without a time
+// get the receive time whatever the policy
+func stampEvents(tracks []Event, policy TimestampPolicy, received time.Time) {
+	now := received.Unix()
+	for i := range tracks {
+		event := &tracks[i]
+		switch {
+		case event.Time == 0, policy.Mode == TimestampServer:
+			event.Time = now
+		case policy.Mode == TimestampTolerance:
+			if event.Time < now-int64(policy.Tolerance) || event.Time > now+int64(policy.Tolerance) {
+				event.Time = now
+			}
+		}
+	}
+}
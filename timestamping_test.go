@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	config := &Config{}
+	config.Timestamping = TimestampingConfig{
+		Mode:      TimestampTolerance,
+		Tolerance: 300,
+		Accounts: map[string]TimestampPolicy{
+			"mobile": {Mode: TimestampTolerance, Tolerance: 60},
+			"legacy": {Mode: TimestampClient},
+		},
+	}
+	useConfig(t, config)
+	tests := []struct {
+		name    string
+		account string
+		header  string
+		query   string
+		want    TimestampPolicy
+	}{
+		{"default", "", "", "", TimestampPolicy{TimestampTolerance, 300}},
+		{"header overrides default", "", "client", "", TimestampPolicy{TimestampClient, 300}},
+		{"query overrides default", "", "", "timestampMode=server&timestampTolerance=5", TimestampPolicy{TimestampServer, 5}},
+		{"account policy", "mobile", "", "", TimestampPolicy{TimestampTolerance, 60}},
+		{"account cannot loosen the mode", "mobile", "client", "", TimestampPolicy{TimestampTolerance, 60}},
+		{"account cannot loosen the tolerance", "mobile", "", "timestampTolerance=600", TimestampPolicy{TimestampTolerance, 60}},
+		{"account tightens the tolerance", "mobile", "", "timestampTolerance=10", TimestampPolicy{TimestampTolerance, 10}},
+		{"account tightens the mode", "mobile", "server", "", TimestampPolicy{TimestampServer, 60}},
+		{"client account tightens to tolerance", "legacy", "tolerance", "timestampTolerance=30", TimestampPolicy{TimestampTolerance, 30}},
+		{"unknown mode is ignored", "", "sometimes", "", TimestampPolicy{TimestampTolerance, 300}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/track?"+test.query, nil)
+			if test.header != "" {
+				c.Request.Header.Set(timestampModeHeader, test.header)
+			}
+			if test.account != "" {
+				c.Set(gin.AuthUserKey, test.account)
+			}
+			if got := timestampPolicy(c); got != test.want {
+				t.Errorf("timestampPolicy() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStampEvents(t *testing.T) {
+	received := time.Unix(1500000000, 0)
+	now := received.Unix()
+	tests := []struct {
+		name   string
+		policy TimestampPolicy
+		time   int64
+		want   int64
+	}{
+		{"client keeps the time", TimestampPolicy{Mode: TimestampClient}, now - 86400, now - 86400},
+		{"missing time is stamped", TimestampPolicy{Mode: TimestampClient}, 0, now},
+		{"server stamps", TimestampPolicy{Mode: TimestampServer}, now - 10, now},
+		{"within tolerance", TimestampPolicy{Mode: TimestampTolerance, Tolerance: 60}, now - 60, now - 60},
+		{"before tolerance", TimestampPolicy{Mode: TimestampTolerance, Tolerance: 60}, now - 61, now},
+		{"after tolerance", TimestampPolicy{Mode: TimestampTolerance, Tolerance: 60}, now + 61, now},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracks := []Event{{Metric: "purchase", Time: test.time}}
+			stampEvents(tracks, test.policy, received)
+			if tracks[0].Time != test.want {
+				t.Errorf("stampEvents() time = %d, want %d", tracks[0].Time, test.want)
+			}
+		})
+	}
+}